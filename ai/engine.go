@@ -0,0 +1,19 @@
+package ai
+
+import "github.com/schollz/pianoai/music"
+
+// Engine lets the AI learn from a music, so it can be
+// used by the player like the AI of ai2
+type Engine struct {
+	*AI
+}
+
+// NewEngine returns a new AI that learns from a music
+func NewEngine() Engine {
+	return Engine{New()}
+}
+
+// Learn learns the transition probabilities of the notes of the music
+func (e Engine) Learn(m *music.Music) (err error) {
+	return e.AI.Learn(m.GetAll())
+}
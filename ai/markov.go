@@ -34,6 +34,10 @@ type AI struct {
 	// MaximumLickLength is the maximum number of notes for a lick
 	MaximumLickLength int
 
+	// UsePedal learns how long notes sound with the sustain
+	// pedal, instead of how long the keys are held down
+	UsePedal bool
+
 	// keep track of whether it is learning,
 	// so learning can be done asynchronously
 	IsLearning bool
@@ -109,40 +113,28 @@ func (m *AI) toggleLearning(l bool) {
 	m.IsLearning = l
 }
 
+// Analyze converts the notes into {Pitch,Velocity,Duration,Lag}
+// where the lag is the number of ticks until the next note.
 func (m *AI) Analyze(notes music.Notes) (analyzedNotes [][]int) {
 
 	analyzedNotes = [][]int{}
-	sort.Sort(notes)
-	// Find a note that turns on
-	for i, note1 := range notes {
-		if !note1.On {
+	spans := music.Spans(notes)
+	for i, span := range spans {
+		// the last note has no lag and unreleased notes have no duration
+		if i == len(spans)-1 || span.Unterminated || span.Pitch < m.HighPassFilter {
 			continue
 		}
-		//              Pitch         Velocity      Duration Lag
-		values := []int{note1.Pitch, note1.Velocity, 10000, 10000}
-		// Loop to find the Duration and the Lag
-		for j, note2 := range notes {
-			// Only consider notes after the current
-			if j <= i {
-				continue
-			}
-			// Find when the current note turns off to get the Duration
-			if !note2.On && note1.Pitch == note2.Pitch && values[2] == 10000 {
-				values[2] = note2.Beat - note1.Beat
-			}
-			// Find when next note turns on to get the Lag
-			if note2.On && values[3] == 10000 {
-				values[3] = note2.Beat - note1.Beat
-			}
-			// If the values are filled, then append and move on
-			if values[2] != 10000 && values[3] != 10000 && values[0] >= m.HighPassFilter {
-				if values[3] <= 6 {
-					values[3] = 0
-				}
-				analyzedNotes = append(analyzedNotes, values)
-				break
-			}
+		lag := spans[i+1].Start - span.Start
+		if lag <= 6 {
+			lag = 0
+		}
+		duration := span.Duration
+		if m.UsePedal {
+			duration = span.Sounding
 		}
+		//              Pitch       Velocity       Duration  Lag
+		values := []int{span.Pitch, span.Velocity, duration, lag}
+		analyzedNotes = append(analyzedNotes, values)
 	}
 	return
 }
@@ -3,7 +3,6 @@ package ai2
 import (
 	"errors"
 	"math/rand"
-	"sort"
 
 	"github.com/schollz/pianoai/music"
 	log "github.com/sirupsen/logrus"
@@ -46,6 +45,10 @@ type AI struct {
 	Stacatto       bool
 	DisallowChords bool
 
+	// UsePedal learns how long notes sound with the sustain
+	// pedal, instead of how long the keys are held down
+	UsePedal bool
+
 	MaxChordDistance int
 	TicksBerBeat     int
 }
@@ -92,12 +95,11 @@ func (ai *AI) decode(s string) []int {
 }
 
 func (ai *AI) Learn(mus *music.Music) (err error) {
-	mus.RLock()
-	defer mus.RUnlock()
 	logger := log.WithFields(log.Fields{
 		"function": "AI.Analyze",
 	})
-	if len(mus.Notes) < ai.WindowSizeMax {
+	spans := mus.Spans()
+	if len(spans) < ai.WindowSizeMax {
 		return errors.New("Too few notes")
 	}
 	logger.Debug("Analyzing...")
@@ -105,58 +107,40 @@ func (ai *AI) Learn(mus *music.Music) (err error) {
 	ai.links = make(map[string]string)
 	ai.chords = make(map[string][]Chord)
 
-	// sort the beats
-	beats := make([]int, len(mus.Notes))
-	beatI := 0
-	for beat := range mus.Notes {
-		if beat == 0 {
-			continue
-		}
-		beats[beatI] = beat
-		beatI++
-	}
-	sort.Ints(beats)
-
-	ai.chordArray = make([]Chord, len(beats))
-	ai.chordStringArray = make([]string, len(beats))
+	ai.chordArray = make([]Chord, len(spans))
+	ai.chordStringArray = make([]string, len(spans))
 	chordArrayI := 0
-	for _, beat1 := range beats {
+	// the notes at tick 0 are learned too: the map of notes used to
+	// skip tick 0 when listing the ticks, but the slot that was left
+	// empty sorted back to the front as a 0, so they always were
+	for i := 0; i < len(spans); {
+		// the notes that start together make a chord
+		j := i
+		for j < len(spans) && spans[j].Start == spans[i].Start {
+			j++
+		}
 		chord := Chord{
 			Pitches: []int{},
 		}
 		duration := 0
-		lag := 0
+		lag := spans[i].Gap
 		velocity := 0
-
-		for note1 := range mus.Notes[beat1] {
-			if !mus.Notes[beat1][note1].On || note1 < ai.HighPassFilter || mus.Notes[beat1][note1].Velocity < 70 || mus.Notes[beat1][note1].Beat != beat1 {
+		for _, span := range spans[i:j] {
+			if span.Pitch < ai.HighPassFilter || span.Velocity < 70 || hasPitch(chord.Pitches, span.Pitch) {
 				continue
 			}
-			chord.Pitches = append(chord.Pitches, note1)
+			chord.Pitches = append(chord.Pitches, span.Pitch)
 			if velocity == 0 {
-				velocity = mus.Notes[beat1][note1].Velocity
+				velocity = span.Velocity
 			}
-			if duration > 0 && lag > 0 {
-				continue
-			}
-			// determine duration and lag
-			for _, beat2 := range beats {
-				if beat2 <= beat1 {
-					continue
-				}
-				for note2 := range mus.Notes[beat2] {
-					if mus.Notes[beat2][note2].Beat != beat2 {
-						continue
-					}
-					if lag == 0 && mus.Notes[beat2][note2].On {
-						lag = beat2 - beat1
-					}
-					if duration == 0 && note2 == note1 && !mus.Notes[beat2][note2].On {
-						duration = beat2 - beat1
-					}
+			if duration == 0 && !span.Unterminated {
+				duration = span.Duration
+				if ai.UsePedal {
+					duration = span.Sounding
 				}
 			}
 		}
+		i = j
 		if len(chord.Pitches) == 0 {
 			continue
 		}
@@ -181,6 +165,16 @@ func (ai *AI) Learn(mus *music.Music) (err error) {
 	return
 }
 
+// hasPitch returns whether the pitch is already in the pitches
+func hasPitch(pitches []int, pitch int) bool {
+	for _, p := range pitches {
+		if p == pitch {
+			return true
+		}
+	}
+	return false
+}
+
 // Lick generates a sequence of chords using the Markov
 // probabilities. Must run Learn() beforehand.
 func (ai *AI) Lick(startBeat int) (lick *music.Music, err error) {
@@ -25,7 +25,7 @@ func TestAI1(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	fmt.Println(m.Notes[960])
+	fmt.Println(m.Notes()[960])
 	ai.Learn(m)
 	fmt.Println("CHORD ARRAY")
 	fmt.Println(ai.chordStringArray)
@@ -34,3 +34,18 @@ func TestAI1(t *testing.T) {
 	}
 	// fmt.Println(ai.Lick(0))
 }
+
+func TestLearnFirstTick(t *testing.T) {
+	ai := New(100)
+	m := music.New()
+	for i := 0; i < 45; i++ {
+		m.AddNote(music.Note{On: true, Pitch: 70 + i%12, Velocity: 100, Beat: i * 100})
+		m.AddNote(music.Note{On: false, Pitch: 70 + i%12, Velocity: 0, Beat: i*100 + 50})
+	}
+	if err := ai.Learn(m); err != nil {
+		t.Fatal(err)
+	}
+	if len(ai.chordArray) != 45 || ai.chordArray[0].Pitches[0] != 70 {
+		t.Errorf("the chord at tick 0 was not learned: %+v", ai.chordArray[0])
+	}
+}
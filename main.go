@@ -2,10 +2,16 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/schollz/pianoai/ai"
 	"github.com/schollz/pianoai/ai2"
+	"github.com/schollz/pianoai/music"
+	"github.com/schollz/pianoai/piano"
 	"github.com/schollz/pianoai/player"
 	"github.com/urfave/cli"
 )
@@ -39,15 +45,20 @@ func main() {
 			Value: 2,
 			Usage: "beats of silence before AI jumps in",
 		},
+		cli.Float64Flag{
+			Name:  "answer",
+			Value: 1,
+			Usage: "length of the answer of the AI, as a part of the phrase you played (0 for the whole improvisation)",
+		},
 		cli.IntFlag{
 			Name:  "quantize",
 			Value: 64,
-			Usage: "1/quantize is shortest possible note",
+			Usage: "snap the notes you play to 1/quantize of a beat (0 to not snap)",
 		},
 		cli.StringFlag{
 			Name:  "file,f",
 			Value: "music_history.json",
-			Usage: "file save/load to when pressing bottom C",
+			Usage: "file save/load to when pressing bottom A (.json, or .pai for binary, add .gz to compress)",
 		},
 		cli.BoolFlag{
 			Name:  "debug",
@@ -78,6 +89,97 @@ func main() {
 			Name:  "follow",
 			Usage: "AI velocities follow the host",
 		},
+		cli.BoolFlag{
+			Name:  "pedal",
+			Usage: "AI learns note lengths with the sustain pedal",
+		},
+		cli.StringSliceFlag{
+			Name:  "train",
+			Usage: "MIDI file for the AI to learn from, without adding it to the history (can be repeated)",
+		},
+		cli.StringFlag{
+			Name:  "input",
+			Usage: "name of the MIDI input device, or a regular expression (see 'pianoai devices')",
+		},
+		cli.StringFlag{
+			Name:  "output",
+			Usage: "name of the MIDI output device, or a regular expression (see 'pianoai devices')",
+		},
+		cli.StringFlag{
+			Name:  "backend",
+			Usage: "MIDI backend to use (" + strings.Join(piano.Backends(), ", ") + "), portmidi is used when it is built in",
+		},
+		cli.StringFlag{
+			Name:  "perform",
+			Usage: "MIDI or session file to play as the host, instead of the keyboard input",
+		},
+		cli.Float64Flag{
+			Name:  "speed",
+			Value: 1,
+			Usage: "speed multiplier for --perform",
+		},
+		cli.StringFlag{
+			Name:  "ai-voice",
+			Value: "1",
+			Usage: "channel[:program[:bank]] of the AI",
+		},
+		cli.StringFlag{
+			Name:  "playback-voice",
+			Value: "1",
+			Usage: "channel[:program[:bank]] for playing back the history",
+		},
+		cli.StringFlag{
+			Name:  "click-voice",
+			Value: "10",
+			Usage: "channel[:program[:bank]] of the click",
+		},
+		cli.BoolFlag{
+			Name:  "click",
+			Usage: "play a click on every beat",
+		},
+		cli.StringFlag{
+			Name:  "clock",
+			Value: "internal",
+			Usage: "internal, external to follow the MIDI clock of the input, or master to send MIDI clock",
+		},
+		cli.StringFlag{
+			Name:  "controls",
+			Usage: "JSON file that binds actions to keys, pedals or control changes",
+		},
+		cli.StringSliceFlag{
+			Name:  "control",
+			Usage: "action=binding, like improvise=cc20 or undo=24+26 (can be repeated)",
+		},
+		cli.StringFlag{
+			Name:  "tempo",
+			Value: "fixed",
+			Usage: "fixed to keep the tempo of --bpm, propose to show the tempo you play at, or follow to change to it",
+		},
+		cli.StringFlag{
+			Name:  "engine",
+			Value: "ai2",
+			Usage: "AI that improvises first (ai2, markov), the engine action switches to the other one",
+		},
+	}
+
+	app.Commands = []cli.Command{
+		{
+			Name:  "devices",
+			Usage: "list the MIDI devices",
+			Action: func(c *cli.Context) (err error) {
+				devices, err := piano.ListDevices(c.GlobalString("backend"))
+				if err != nil {
+					return
+				}
+				if len(devices) == 0 {
+					fmt.Println("No MIDI devices found")
+				}
+				for _, device := range devices {
+					fmt.Println(device)
+				}
+				return
+			},
+		},
 	}
 
 	app.Action = func(c *cli.Context) (err error) {
@@ -102,25 +204,154 @@ func main() {
 
 	 Lets play some music!
 											`)
-		p, err := player.New(c.GlobalInt("bpm"), c.GlobalInt("tick"), c.GlobalBool("debug"))
+		voices := make([]piano.Voice, 3)
+		for i, name := range []string{"ai-voice", "playback-voice", "click-voice"} {
+			voices[i], err = piano.ParseVoice(c.GlobalString(name))
+			if err != nil {
+				return
+			}
+		}
+		historyFile := c.GlobalString("file")
+		var device piano.Device
+		device, err = piano.Watch(c.GlobalString("backend"), c.GlobalString("input"), c.GlobalString("output"))
+		if err != nil {
+			return
+		}
+		if filename := c.GlobalString("perform"); filename != "" {
+			performance, errOpen := openPerformance(filename, c.GlobalInt("bpm"), c.GlobalInt("tick"))
+			if errOpen != nil {
+				return errOpen
+			}
+			// the performance is recorded into a copy of the
+			// history, so it does not change what was learned
+			historyFile, err = copyHistory(historyFile)
+			if err != nil {
+				return
+			}
+			defer os.RemoveAll(filepath.Dir(historyFile))
+			performer := piano.NewPerformer(performance, device)
+			performer.Speed = c.GlobalFloat64("speed")
+			device = performer
+		}
+		p, err := player.NewWithDevice(c.GlobalInt("bpm"), c.GlobalInt("tick"), historyFile, c.GlobalBool("debug"), device)
 		if err != nil {
 			return
 		}
 		p.HighPassFilter = c.GlobalInt("hp")
+		p.Quantize = c.GlobalInt("quantize")
+		p.BeatsOfSilence = c.GlobalInt("waits")
+		p.AnswerLength = c.GlobalFloat64("answer")
 		p.AI = ai2.New(p.TicksPerBeat)
 		p.AI.HighPassFilter = c.GlobalInt("hp")
 		p.AI.LinkLength = c.GlobalInt("link")
 		p.AI.Jazzy = c.GlobalBool("jazzy")
 		p.AI.Stacatto = c.GlobalBool("stacatto")
 		p.AI.DisallowChords = !c.GlobalBool("chords")
+		p.AI.UsePedal = c.GlobalBool("pedal")
+		markov := ai.NewEngine()
+		markov.HighPassFilter = c.GlobalInt("hp")
+		markov.UsePedal = c.GlobalBool("pedal")
+		switch c.GlobalString("engine") {
+		case "ai2":
+			p.Engines = []player.Engine{p.AI, markov}
+		case "markov":
+			p.Engines = []player.Engine{markov, p.AI}
+		default:
+			p.Close()
+			return fmt.Errorf("unknown engine %q", c.GlobalString("engine"))
+		}
+		switch c.GlobalString("tempo") {
+		case "fixed":
+		case "propose":
+			p.EstimateTempo = true
+		case "follow":
+			p.FollowTempo = true
+		default:
+			p.Close()
+			return fmt.Errorf("unknown tempo %q", c.GlobalString("tempo"))
+		}
+		if filename := c.GlobalString("controls"); filename != "" {
+			err = p.Controls.Load(filename)
+		}
+		for _, control := range c.GlobalStringSlice("control") {
+			if err != nil {
+				break
+			}
+			err = p.Controls.Set(control)
+		}
+		if err != nil {
+			p.Close()
+			return
+		}
 		p.ManualAI = c.GlobalBool("manual")
 		p.UseHostVelocity = c.GlobalBool("follow")
+		p.Click = c.GlobalBool("click")
+		switch c.GlobalString("clock") {
+		case "internal":
+		case "external":
+			p.Clock = player.NewExternalClock()
+		case "master":
+			p.Clock = player.NewMasterClock(c.GlobalInt("tick"))
+		default:
+			p.Close()
+			return fmt.Errorf("unknown clock %q", c.GlobalString("clock"))
+		}
+		p.AIVoice = voices[0]
+		p.PlaybackVoice = voices[1]
+		p.ClickVoice = voices[2]
+		for _, filename := range c.GlobalStringSlice("train") {
+			err = p.LoadMIDI(filename)
+			if err != nil {
+				p.Close()
+				return
+			}
+		}
 		p.Start()
-		return nil
+		return p.Close()
 	}
 
 	err := app.Run(os.Args)
 	if err != nil {
-		fmt.Print(err)
+		fmt.Println(err)
+	}
+}
+
+// openPerformance opens a MIDI file or a session file to perform,
+// using the tempo of the flags when the file has none
+func openPerformance(filename string, bpm, tickHertz int) (m *music.Music, err error) {
+	ticksPerBeat := tickHertz * 60 / bpm
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".mid", ".midi":
+		m, err = music.OpenMIDI(filename, bpm, ticksPerBeat)
+	default:
+		// the journal is left out, so only what was saved is performed
+		m, err = music.OpenSaved(filename)
+	}
+	if err != nil {
+		return
+	}
+	if m.BPM == 0 || m.TicksPerBeat == 0 {
+		m.BPM = bpm
+		m.TicksPerBeat = ticksPerBeat
+	}
+	return
+}
+
+// copyHistory saves the music history, with the notes of its journal,
+// to a file in a new temporary directory, and returns its name
+func copyHistory(filename string) (copied string, err error) {
+	m, err := music.Open(filename)
+	if os.IsNotExist(err) {
+		m, err = music.New(), nil
+	}
+	if err != nil {
+		return
+	}
+	dir, err := ioutil.TempDir("", "pianoai")
+	if err != nil {
+		return
 	}
+	copied = filepath.Join(dir, filepath.Base(filename))
+	err = m.Save(copied)
+	return
 }
@@ -0,0 +1,190 @@
+package music
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BinaryExtension is the extension of files saved in the compact
+// binary format. Files ending with ".gz" are also gzipped, for
+// example "history.pai.gz" or "history.json.gz".
+const BinaryExtension = ".pai"
+
+// binaryMagic starts every file in the binary format
+var binaryMagic = []byte("PIAI")
+
+// binaryVersion is the version of the binary format
+const binaryVersion = 1
+
+// isBinaryFile returns whether the file should be saved in the binary format
+func isBinaryFile(filename string) bool {
+	return filepath.Ext(strings.TrimSuffix(filename, ".gz")) == BinaryExtension
+}
+
+// encode returns the contents of a session file, in the format
+// chosen by its extension. The lock must be held.
+func (m *Music) encode(filename string) (data []byte, err error) {
+	if isBinaryFile(filename) {
+		data = m.marshalBinary()
+	} else {
+		data, err = m.marshalJSON()
+		if err != nil {
+			return
+		}
+	}
+	if filepath.Ext(filename) != ".gz" {
+		return
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(data)
+	err = gz.Close()
+	return buf.Bytes(), err
+}
+
+// decode reads the contents of a session file in any format,
+// which is recognized from the data. The lock must be held.
+func (m *Music) decode(filename string, data []byte) (err error) {
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		gz, errGzip := gzip.NewReader(bytes.NewReader(data))
+		if errGzip != nil {
+			return errGzip
+		}
+		data, err = ioutil.ReadAll(gz)
+		if err != nil {
+			return
+		}
+	}
+	if bytes.HasPrefix(data, binaryMagic) {
+		return m.unmarshalBinary(data[len(binaryMagic):])
+	}
+	return m.load(filename, data)
+}
+
+// marshalBinary encodes the music with variable-length integers. The
+// notes are kept in order, and each tick is stored as the difference
+// to the tick of the previous note. The lock must be held.
+func (m *Music) marshalBinary() []byte {
+	var buf bytes.Buffer
+	scratch := make([]byte, binary.MaxVarintLen64)
+	putUvarint := func(value int) {
+		if value < 0 {
+			value = 0
+		}
+		buf.Write(scratch[:binary.PutUvarint(scratch, uint64(value))])
+	}
+	putVarint := func(value int64) {
+		buf.Write(scratch[:binary.PutVarint(scratch, value)])
+	}
+	putString := func(s string) {
+		putUvarint(len(s))
+		buf.WriteString(s)
+	}
+
+	buf.Write(binaryMagic)
+	putUvarint(binaryVersion)
+	putUvarint(m.BPM)
+	putUvarint(m.TicksPerBeat)
+	putString(m.Key)
+	putUvarint(m.TimeSignature.Beats)
+	putUvarint(m.TimeSignature.Unit)
+	putString(m.Device)
+	if m.Created.IsZero() {
+		putVarint(0)
+	} else {
+		putVarint(m.Created.UnixNano())
+	}
+
+	putUvarint(len(m.events))
+	previousBeat := 0
+	for _, note := range m.events {
+		putVarint(int64(note.Beat - previousBeat))
+		previousBeat = note.Beat
+		// flags: on, kind and channel
+		flags := int(note.Kind)<<1 | (note.Channel&0x0F)<<4
+		if note.On {
+			flags |= 1
+		}
+		buf.WriteByte(byte(flags))
+		putUvarint(note.Pitch)
+		putUvarint(note.Velocity)
+	}
+	return buf.Bytes()
+}
+
+// unmarshalBinary decodes the music after the magic, the lock must be held
+func (m *Music) unmarshalBinary(data []byte) (err error) {
+	errTruncated := errors.New("truncated binary music")
+	r := bytes.NewReader(data)
+	getUvarint := func() int {
+		value, errRead := binary.ReadUvarint(r)
+		if errRead != nil {
+			err = errTruncated
+		}
+		return int(value)
+	}
+	getVarint := func() int64 {
+		value, errRead := binary.ReadVarint(r)
+		if errRead != nil {
+			err = errTruncated
+		}
+		return value
+	}
+	getString := func() string {
+		length := getUvarint()
+		if err != nil || length > r.Len() {
+			err = errTruncated
+			return ""
+		}
+		s := make([]byte, length)
+		r.Read(s)
+		return string(s)
+	}
+
+	if version := getUvarint(); err == nil && version > binaryVersion {
+		return errors.New("unsupported binary music version")
+	}
+	m.BPM = getUvarint()
+	m.TicksPerBeat = getUvarint()
+	m.Key = getString()
+	m.TimeSignature.Beats = getUvarint()
+	m.TimeSignature.Unit = getUvarint()
+	m.Device = getString()
+	if created := getVarint(); created != 0 {
+		m.Created = time.Unix(0, created)
+	} else {
+		m.Created = time.Time{}
+	}
+	numNotes := getUvarint()
+	if err != nil {
+		return
+	}
+
+	beat := 0
+	for i := 0; i < numNotes; i++ {
+		beat += int(getVarint())
+		flags, errRead := r.ReadByte()
+		if errRead != nil {
+			return errTruncated
+		}
+		note := Note{
+			On:      flags&1 == 1,
+			Kind:    Kind(flags >> 1 & 0x07),
+			Channel: int(flags >> 4),
+			Beat:    beat,
+		}
+		note.Pitch = getUvarint()
+		note.Velocity = getUvarint()
+		if err != nil {
+			return
+		}
+		m.add(note)
+	}
+	return
+}
@@ -0,0 +1,73 @@
+package music
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBinaryRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "music")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fixtures, _ := filepath.Glob("../testing/*.json")
+	if len(fixtures) == 0 {
+		t.Fatal("no fixtures")
+	}
+	for _, fixture := range fixtures {
+		m, err := Open(fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.BPM = 120
+		m.TicksPerBeat = 250
+		m.Device = "Digital Piano"
+		m.AddNote(Note{Kind: PitchBendEvent, Velocity: 16383, Beat: 10, Channel: 15})
+		m.AddNote(Note{Kind: ControlEvent, Pitch: SustainPedal, Velocity: 127, Beat: 5})
+
+		jsonSize := int64(0)
+		for _, name := range []string{"session.json", "session.pai", "session.pai.gz", "session.json.gz"} {
+			filename := filepath.Join(dir, name)
+			if err = m.Save(filename); err != nil {
+				t.Fatal(err)
+			}
+			stat, _ := os.Stat(filename)
+			if name == "session.json" {
+				jsonSize = stat.Size()
+			} else if stat.Size() >= jsonSize {
+				t.Errorf("%s is %d bytes, not smaller than %d bytes of JSON", name, stat.Size(), jsonSize)
+			}
+
+			m2, err := Open(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m2.BPM != m.BPM || m2.TicksPerBeat != m.TicksPerBeat || m2.Device != m.Device || m2.TimeSignature != m.TimeSignature || !m2.Created.Equal(m.Created) {
+				t.Errorf("%s: info %+v, expected %+v", name, m2.Info, m.Info)
+			}
+			notes, expected := m2.GetAll(), m.GetAll()
+			if len(notes) != len(expected) {
+				t.Fatalf("%s: %d notes, expected %d", name, len(notes), len(expected))
+			}
+			for i := range notes {
+				if notes[i] != expected[i] {
+					t.Errorf("%s: note %d is %+v, expected %+v", name, i, notes[i], expected[i])
+				}
+			}
+		}
+	}
+}
+
+func TestBinaryTruncated(t *testing.T) {
+	m := New()
+	m.AddNote(Note{On: true, Pitch: 60, Velocity: 80, Beat: 1000})
+	data := m.marshalBinary()
+	m2 := New()
+	if err := m2.decode("session.pai", data[:len(data)-1]); err == nil {
+		t.Error("expected error for truncated data")
+	}
+}
@@ -0,0 +1,175 @@
+package music
+
+import (
+	"math"
+	"sort"
+)
+
+// The editing operations below return a new music with the same Info,
+// and never change the music they are called on.
+
+// each returns a copy of the music with the function applied to every
+// note, in order. Notes are dropped when the function returns false.
+func (m *Music) each(f func(note Note) (Note, bool)) *Music {
+	edited := New()
+	m.RLock()
+	edited.Info = m.Info
+	m.RUnlock()
+	m.Each(func(note Note) bool {
+		if note, keep := f(note); keep {
+			edited.add(note)
+		}
+		return true
+	})
+	return edited
+}
+
+// Transpose moves every note by a number of semitones. Notes that
+// would leave the MIDI range are moved back into it by octaves.
+func (m *Music) Transpose(semitones int) *Music {
+	return m.each(func(note Note) (Note, bool) {
+		if !note.IsNote() {
+			return note, true
+		}
+		note.Pitch += semitones
+		for note.Pitch > 127 {
+			note.Pitch -= 12
+		}
+		for note.Pitch < 0 {
+			note.Pitch += 12
+		}
+		return note, true
+	})
+}
+
+// Shift moves every note by a number of ticks
+func (m *Music) Shift(ticks int) *Music {
+	return m.each(func(note Note) (Note, bool) {
+		note.Beat += ticks
+		return note, true
+	})
+}
+
+// Slice returns the notes from the tick from up to, but not including,
+// the tick to. Notes still pressed at the end of the window are released
+// at the tick to, and releases of notes pressed before the window are
+// dropped. The ticks are not moved, use Shift to start at zero.
+func (m *Music) Slice(from, to int) *Music {
+	// pressed counts the notes of each channel and pitch that are down
+	pressed := make(map[[2]int]int)
+	sliced := m.each(func(note Note) (Note, bool) {
+		if note.Beat < from || note.Beat >= to {
+			return note, false
+		}
+		if !note.IsNote() {
+			return note, true
+		}
+		key := [2]int{note.Channel, note.Pitch}
+		if note.On {
+			pressed[key]++
+		} else if pressed[key] == 0 {
+			return note, false
+		} else {
+			pressed[key]--
+		}
+		return note, true
+	})
+	// the releases are added by channel and pitch, so that
+	// slicing the same music always gives the same notes
+	keys := make([][2]int, 0, len(pressed))
+	for key := range pressed {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for _, key := range keys {
+		for i := 0; i < pressed[key]; i++ {
+			sliced.add(Note{On: false, Pitch: key[1], Velocity: 0, Beat: to, Channel: key[0]})
+		}
+	}
+	return sliced
+}
+
+// Merge returns the notes of both musics, with the Info of the first
+func (m *Music) Merge(other *Music) *Music {
+	merged := m.each(func(note Note) (Note, bool) {
+		return note, true
+	})
+	other.Each(func(note Note) bool {
+		merged.add(note)
+		return true
+	})
+	return merged
+}
+
+// Stretch multiplies the tick of every note by a factor
+func (m *Music) Stretch(factor float64) *Music {
+	return m.each(func(note Note) (Note, bool) {
+		note.Beat = int(math.Floor(float64(note.Beat)*factor + 0.5))
+		return note, true
+	})
+}
+
+// Rescale returns a copy of the music with the ticks converted to
+// a different resolution, keeping the notes on the same beats.
+func (m *Music) Rescale(ticksPerBeat int) (rescaled *Music) {
+	m.RLock()
+	factor := 1.0
+	if m.TicksPerBeat > 0 {
+		factor = float64(ticksPerBeat) / float64(m.TicksPerBeat)
+	}
+	m.RUnlock()
+	rescaled = m.Stretch(factor)
+	rescaled.TicksPerBeat = ticksPerBeat
+	return
+}
+
+// Retempo returns a copy of the music played at a different tempo by a
+// player with the same tick rate, which changes the ticks per beat.
+func (m *Music) Retempo(bpm int) (retimed *Music) {
+	m.RLock()
+	oldBPM, ticksPerBeat := m.BPM, m.TicksPerBeat
+	m.RUnlock()
+	if oldBPM <= 0 || bpm <= 0 {
+		retimed = m.Stretch(1)
+		retimed.BPM = bpm
+		return
+	}
+	retimed = m.Stretch(float64(oldBPM) / float64(bpm))
+	retimed.BPM = bpm
+	retimed.TicksPerBeat = ticksPerBeat * oldBPM / bpm
+	return
+}
+
+// Quantize moves every event to the closest multiple of grid ticks.
+// Notes that would become shorter than the grid last one grid, and
+// releases of notes that were never pressed are dropped.
+func (m *Music) Quantize(grid int) *Music {
+	if grid <= 1 {
+		return m.Stretch(1)
+	}
+	snap := func(beat int) int {
+		return int(math.Floor(float64(beat)/float64(grid)+0.5)) * grid
+	}
+	quantized := m.each(func(note Note) (Note, bool) {
+		note.Beat = snap(note.Beat)
+		return note, !note.IsNote()
+	})
+	for _, span := range m.Spans() {
+		start := snap(span.Start)
+		quantized.add(Note{On: true, Pitch: span.Pitch, Velocity: span.Velocity, Beat: start, Channel: span.Channel})
+		if span.Unterminated {
+			continue
+		}
+		end := snap(span.Start + span.Duration)
+		if end <= start {
+			end = start + grid
+		}
+		quantized.add(Note{On: false, Pitch: span.Pitch, Velocity: span.ReleaseVelocity, Beat: end, Channel: span.Channel})
+	}
+	return quantized
+}
@@ -0,0 +1,104 @@
+package music
+
+import "testing"
+
+func testMusic() *Music {
+	m := New()
+	m.BPM = 120
+	m.TicksPerBeat = 100
+	m.AddNote(Note{On: true, Pitch: 60, Velocity: 80, Beat: 3})
+	m.AddNote(Note{On: false, Pitch: 60, Velocity: 10, Beat: 52})
+	m.AddNote(Note{On: true, Pitch: 120, Velocity: 70, Beat: 98})
+	m.AddNote(Note{On: false, Pitch: 120, Velocity: 0, Beat: 151})
+	return m
+}
+
+func TestTransposeShift(t *testing.T) {
+	m := testMusic()
+	transposed := m.Transpose(10)
+	notes := transposed.GetAll()
+	if notes[0].Pitch != 70 || notes[2].Pitch != 118 {
+		t.Errorf("bad transpose %+v", notes)
+	}
+	if m.GetAll()[0].Pitch != 60 {
+		t.Error("source was changed")
+	}
+	if transposed.TicksPerBeat != 100 {
+		t.Error("info not kept")
+	}
+
+	notes = m.Shift(-3).GetAll()
+	if notes[0].Beat != 0 || notes[3].Beat != 148 {
+		t.Errorf("bad shift %+v", notes)
+	}
+}
+
+func TestSliceMerge(t *testing.T) {
+	m := testMusic()
+	notes := m.Slice(50, 100).GetAll()
+	expected := []Note{
+		{On: true, Pitch: 120, Velocity: 70, Beat: 98},
+		{On: false, Pitch: 120, Velocity: 0, Beat: 100},
+	}
+	if len(notes) != len(expected) || notes[0] != expected[0] || notes[1] != expected[1] {
+		t.Errorf("bad slice %+v", notes)
+	}
+
+	// the notes still pressed are released by channel and pitch
+	chord := New()
+	for _, pitch := range []int{67, 60, 64, 72, 55} {
+		chord.AddNote(Note{On: true, Pitch: pitch, Velocity: 80, Beat: 0, Channel: pitch % 2})
+	}
+	_, releases := chord.Slice(0, 10).Get(10)
+	for i, pitch := range []int{60, 64, 72, 55, 67} {
+		if i >= len(releases) || releases[i].Pitch != pitch {
+			t.Fatalf("bad releases %+v", releases)
+		}
+	}
+
+	merged := m.Merge(m.Shift(200))
+	if merged.Len() != 8 {
+		t.Errorf("expected 8 notes, got %d", merged.Len())
+	}
+	if last, _ := merged.Last(); last != 351 {
+		t.Errorf("bad merge, last is %d", last)
+	}
+}
+
+func TestStretchQuantize(t *testing.T) {
+	m := testMusic()
+	notes := m.Stretch(2).GetAll()
+	if notes[1].Beat != 104 || notes[3].Beat != 302 {
+		t.Errorf("bad stretch %+v", notes)
+	}
+
+	rescaled := m.Rescale(50)
+	if rescaled.TicksPerBeat != 50 || rescaled.GetAll()[3].Beat != 76 {
+		t.Errorf("bad rescale %+v", rescaled.GetAll())
+	}
+
+	retimed := m.Retempo(60)
+	if retimed.BPM != 60 || retimed.TicksPerBeat != 200 || retimed.GetAll()[2].Beat != 196 {
+		t.Errorf("bad retempo %+v %+v", retimed.Info, retimed.GetAll())
+	}
+
+	m.AddNote(Note{On: true, Pitch: 64, Velocity: 80, Beat: 160})
+	m.AddNote(Note{On: false, Pitch: 64, Velocity: 0, Beat: 162})
+	notes = m.Quantize(25).GetAll()
+	expected := []Note{
+		{On: true, Pitch: 60, Velocity: 80, Beat: 0},
+		{On: false, Pitch: 60, Velocity: 10, Beat: 50},
+		{On: true, Pitch: 120, Velocity: 70, Beat: 100},
+		{On: false, Pitch: 120, Velocity: 0, Beat: 150},
+		{On: true, Pitch: 64, Velocity: 80, Beat: 150},
+		{On: false, Pitch: 64, Velocity: 0, Beat: 175},
+	}
+	if len(notes) != len(expected) {
+		t.Fatalf("bad quantize %+v", notes)
+	}
+	for i := range notes {
+		if notes[i] != expected[i] {
+			t.Errorf("note %d: expected %+v, got %+v", i, expected[i], notes[i])
+		}
+	}
+}
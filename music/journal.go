@@ -0,0 +1,220 @@
+package music
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	// JournalSyncNotes is how many notes are written to a
+	// journal before it is synced to disk
+	JournalSyncNotes = 32
+	// JournalSyncInterval is the longest time a note written
+	// to a journal waits before it is synced to disk
+	JournalSyncInterval = 500 * time.Millisecond
+)
+
+// journalEntry is a line of the journal. The sequence is the position
+// of the note in the music, so that notes that were already compacted
+// into the session file are not replayed twice.
+type journalEntry struct {
+	Seq  int
+	Note Note
+}
+
+// journal is an append-only file with one entry per line
+type journal struct {
+	session string
+	file    *os.File
+	writer  *bufio.Writer
+	pending int
+	timer   *time.Timer
+	sync.Mutex
+}
+
+// JournalFile returns the name of the journal of a session file
+func JournalFile(filename string) string {
+	return filename + ".journal"
+}
+
+// StartJournal writes every note added from now on to the journal of
+// the session file, so that Open can recover them after a crash.
+func (m *Music) StartJournal(filename string) (err error) {
+	f, err := os.OpenFile(JournalFile(filename), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	// a line that was partly written before a crash is ended,
+	// so that new entries start on their own line
+	if stat, errStat := f.Stat(); errStat == nil && stat.Size() > 0 {
+		last := make([]byte, 1)
+		if _, errRead := f.ReadAt(last, stat.Size()-1); errRead == nil && last[0] != '\n' {
+			f.Write([]byte{'\n'})
+		}
+	}
+	m.Lock()
+	defer m.Unlock()
+	if m.journal != nil {
+		m.journal.close()
+	}
+	m.journal = &journal{
+		session: filename,
+		file:    f,
+		writer:  bufio.NewWriter(f),
+	}
+	return
+}
+
+// StopJournal syncs and closes the journal
+func (m *Music) StopJournal() (err error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.journal == nil {
+		return
+	}
+	err = m.journal.close()
+	m.journal = nil
+	return
+}
+
+// Compact saves the music to the session file of the journal,
+// after which the journal is emptied.
+func (m *Music) Compact() (err error) {
+	// no notes can be added between saving and emptying the journal
+	m.Lock()
+	defer m.Unlock()
+	if m.journal == nil {
+		return errors.New("no journal to compact")
+	}
+	err = m.save(m.journal.session)
+	if err != nil {
+		return
+	}
+	return m.journal.truncate()
+}
+
+// write adds a note to the journal, syncing when enough notes
+// are waiting or after JournalSyncInterval.
+func (j *journal) write(seq int, n Note) (err error) {
+	j.Lock()
+	defer j.Unlock()
+	bEntry, err := json.Marshal(journalEntry{Seq: seq, Note: n})
+	if err != nil {
+		return
+	}
+	j.writer.Write(bEntry)
+	err = j.writer.WriteByte('\n')
+	if err != nil {
+		return
+	}
+	j.pending++
+	if j.pending >= JournalSyncNotes {
+		return j.sync()
+	}
+	if j.timer == nil {
+		j.timer = time.AfterFunc(JournalSyncInterval, func() {
+			j.Lock()
+			defer j.Unlock()
+			j.sync()
+		})
+	}
+	return
+}
+
+// sync flushes the journal to disk, the lock must be held
+func (j *journal) sync() (err error) {
+	if j.timer != nil {
+		j.timer.Stop()
+		j.timer = nil
+	}
+	if j.pending == 0 {
+		return
+	}
+	j.pending = 0
+	err = j.writer.Flush()
+	if err != nil {
+		return
+	}
+	return j.file.Sync()
+}
+
+// truncate empties the journal
+func (j *journal) truncate() (err error) {
+	j.Lock()
+	defer j.Unlock()
+	j.writer.Reset(j.file)
+	j.pending = 0
+	err = j.file.Truncate(0)
+	if err != nil {
+		return
+	}
+	return j.file.Sync()
+}
+
+// close syncs and closes the journal
+func (j *journal) close() (err error) {
+	j.Lock()
+	defer j.Unlock()
+	err = j.sync()
+	if err != nil {
+		j.file.Close()
+		return
+	}
+	return j.file.Close()
+}
+
+// replayJournal adds the notes of a journal that are not yet in the
+// music, the lock must be held. Lines that were only partly written
+// when the program stopped are skipped.
+func (m *Music) replayJournal(filename string) (replayed int, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry journalEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		if entry.Seq < len(m.events) {
+			continue
+		}
+		m.add(entry.Note)
+		replayed++
+	}
+	return
+}
+
+// writeFileAtomic writes the file by renaming a synced temporary file,
+// so the file is never left partly written.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return
+}
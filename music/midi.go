@@ -0,0 +1,409 @@
+package music
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+)
+
+// WriteMIDI writes the music as a Type 1 Standard MIDI File. The first
+// track holds the tempo map and the second holds the notes. The
+// resolution (PPQ) is ticksPerBeat, so every tick of the music is
+// one MIDI tick, and the tempo is derived from the bpm.
+func (m *Music) WriteMIDI(w io.Writer, bpm, ticksPerBeat int) (err error) {
+	if bpm <= 0 {
+		return errors.New("bpm must be positive")
+	}
+	if ticksPerBeat <= 0 || ticksPerBeat > 0x7FFF {
+		return errors.New("ticks per beat must be between 1 and 32767")
+	}
+
+	notes := m.GetAll()
+	sort.Stable(midiOrder(notes))
+	m.RLock()
+	timeSignature := m.TimeSignature
+	m.RUnlock()
+	if timeSignature.Beats <= 0 || timeSignature.Unit <= 0 {
+		timeSignature = TimeSignature{4, 4}
+	}
+	// the unit is written as a power of two
+	unitPower := byte(0)
+	for unit := timeSignature.Unit; unit > 1; unit >>= 1 {
+		unitPower++
+	}
+
+	// tempo track: tempo and time signature
+	tempo := 60000000 / bpm
+	var tempoTrack bytes.Buffer
+	tempoTrack.Write([]byte{0x00, 0xFF, 0x51, 0x03, byte(tempo >> 16), byte(tempo >> 8), byte(tempo)})
+	tempoTrack.Write([]byte{0x00, 0xFF, 0x58, 0x04, clamp7(timeSignature.Beats), unitPower, 0x18, 0x08})
+	tempoTrack.Write([]byte{0x00, 0xFF, 0x2F, 0x00})
+
+	// note track
+	var noteTrack bytes.Buffer
+	previousBeat := 0
+	if len(notes) > 0 && notes[0].Beat < 0 {
+		previousBeat = notes[0].Beat
+	}
+	for _, note := range notes {
+		writeVarint(&noteTrack, note.Beat-previousBeat)
+		previousBeat = note.Beat
+		status, data1, data2 := note.MIDI()
+		noteTrack.Write([]byte{byte(status), byte(data1), byte(data2)})
+	}
+	noteTrack.Write([]byte{0x00, 0xFF, 0x2F, 0x00})
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString("MThd")
+	binary.Write(bw, binary.BigEndian, []uint32{6})
+	binary.Write(bw, binary.BigEndian, []uint16{1, 2, uint16(ticksPerBeat)})
+	for _, track := range []*bytes.Buffer{&tempoTrack, &noteTrack} {
+		bw.WriteString("MTrk")
+		binary.Write(bw, binary.BigEndian, uint32(track.Len()))
+		bw.Write(track.Bytes())
+	}
+	return bw.Flush()
+}
+
+// SaveMIDI saves the music as a Standard MIDI File
+func (m *Music) SaveMIDI(filename string, bpm, ticksPerBeat int) (err error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return
+	}
+	err = m.WriteMIDI(f, bpm, ticksPerBeat)
+	if err != nil {
+		f.Close()
+		return
+	}
+	return f.Close()
+}
+
+// FromMIDI converts a MIDI message into a note at a beat. Only
+// notes, control changes and pitch bends are converted.
+func FromMIDI(status, data1, data2, beat int) (n Note, ok bool) {
+	if status < 0x80 || status >= 0xF0 {
+		return
+	}
+	n = Note{
+		Pitch:    data1,
+		Velocity: data2,
+		Beat:     beat,
+		Channel:  status & 0x0F,
+	}
+	switch status & 0xF0 {
+	case 0x90:
+		// a note on without velocity turns the note off
+		n.On = data2 > 0
+	case 0x80:
+	case 0xB0:
+		n.Kind = ControlEvent
+	case 0xE0:
+		n.Kind = PitchBendEvent
+		n.Pitch = 0
+		n.Velocity = data2<<7 | data1
+	default:
+		return Note{}, false
+	}
+	ok = true
+	return
+}
+
+// MIDI returns the MIDI message of the note
+func (n *Note) MIDI() (status, data1, data2 int) {
+	channel := n.Channel & 0x0F
+	switch n.Kind {
+	case ControlEvent:
+		return 0xB0 | channel, int(clamp7(n.Pitch)), int(clamp7(n.Velocity))
+	case PitchBendEvent:
+		bend := n.Velocity
+		if bend < 0 {
+			bend = 0
+		} else if bend > 0x3FFF {
+			bend = 0x3FFF
+		}
+		return 0xE0 | channel, bend & 0x7F, bend >> 7
+	}
+	if n.On {
+		return 0x90 | channel, int(clamp7(n.Pitch)), int(clamp7(n.Velocity))
+	}
+	return 0x80 | channel, int(clamp7(n.Pitch)), int(clamp7(n.Velocity))
+}
+
+// midiOrder sorts notes by beat, turning notes off before
+// turning new ones on so that repeated pitches are not cut short.
+type midiOrder []Note
+
+func (p midiOrder) Len() int {
+	return len(p)
+}
+
+func (p midiOrder) Less(i, j int) bool {
+	if p[i].Beat != p[j].Beat {
+		return p[i].Beat < p[j].Beat
+	}
+	return !p[i].On && p[j].On
+}
+
+func (p midiOrder) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+}
+
+// writeVarint writes a MIDI variable-length quantity
+func writeVarint(buf *bytes.Buffer, value int) {
+	if value < 0 {
+		value = 0
+	}
+	stack := []byte{byte(value & 0x7F)}
+	value >>= 7
+	for value > 0 {
+		stack = append(stack, byte(value&0x7F)|0x80)
+		value >>= 7
+	}
+	for i := len(stack) - 1; i >= 0; i-- {
+		buf.WriteByte(stack[i])
+	}
+}
+
+// clamp7 limits a value to the 7-bit range of MIDI data bytes
+func clamp7(value int) byte {
+	if value < 0 {
+		return 0
+	}
+	if value > 127 {
+		return 127
+	}
+	return byte(value)
+}
+
+// midiEvent is a channel event read from a Standard MIDI File,
+// positioned at the absolute tick of the file
+type midiEvent struct {
+	tick   int
+	status byte
+	data1  byte
+	data2  byte
+}
+
+// tempoChange sets the microseconds per beat from a tick onwards
+type tempoChange struct {
+	tick  int
+	tempo int
+}
+
+// OpenMIDI opens a Standard MIDI File, see ReadMIDI
+func OpenMIDI(filename string, bpm, ticksPerBeat int) (m *Music, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return New(), err
+	}
+	defer f.Close()
+	return ReadMIDI(bufio.NewReader(f), bpm, ticksPerBeat)
+}
+
+// ReadMIDI reads a Standard MIDI File (format 0, 1 or 2) and converts
+// the notes, control changes and pitch bends of every track into music.
+// The tempo map of the file is followed so the timing of the performance
+// is preserved, and the time is converted to ticks of a player running
+// at bpm with ticksPerBeat.
+func ReadMIDI(r io.Reader, bpm, ticksPerBeat int) (m *Music, err error) {
+	m = New()
+	if bpm <= 0 || ticksPerBeat <= 0 {
+		return m, errors.New("bpm and ticks per beat must be positive")
+	}
+
+	chunkType, header, err := readChunk(r)
+	if err != nil {
+		return
+	}
+	if chunkType != "MThd" || len(header) < 6 {
+		return m, errors.New("not a Standard MIDI File")
+	}
+	numTracks := int(binary.BigEndian.Uint16(header[2:4]))
+	division := binary.BigEndian.Uint16(header[4:6])
+
+	events := []midiEvent{}
+	tempos := []tempoChange{}
+	for track := 0; track < numTracks; {
+		chunkType, data, errChunk := readChunk(r)
+		if errChunk != nil {
+			return m, errChunk
+		}
+		// unknown chunks must be skipped
+		if chunkType != "MTrk" {
+			continue
+		}
+		track++
+		trackEvents, trackTempos, errTrack := parseTrack(data)
+		if errTrack != nil {
+			return m, errTrack
+		}
+		events = append(events, trackEvents...)
+		tempos = append(tempos, trackTempos...)
+	}
+
+	// microseconds of each tick of the file
+	var microsecondsAt func(tick int) float64
+	if division&0x8000 != 0 {
+		// SMPTE timing: negative frames per second and ticks per frame
+		fps := float64(-int8(division >> 8))
+		if fps == 29 {
+			fps = 29.97
+		}
+		ticksPerFrame := float64(division & 0xFF)
+		if fps <= 0 || ticksPerFrame == 0 {
+			return m, errors.New("bad SMPTE division")
+		}
+		microsecondsAt = func(tick int) float64 {
+			return float64(tick) * 1000000 / (fps * ticksPerFrame)
+		}
+	} else {
+		if division == 0 {
+			return m, errors.New("bad division")
+		}
+		sort.SliceStable(tempos, func(i, j int) bool {
+			return tempos[i].tick < tempos[j].tick
+		})
+		microsecondsAt = func(tick int) float64 {
+			microseconds := 0.0
+			lastTick := 0
+			tempo := 500000
+			for _, change := range tempos {
+				if change.tick >= tick {
+					break
+				}
+				microseconds += float64(change.tick-lastTick) * float64(tempo) / float64(division)
+				lastTick = change.tick
+				tempo = change.tempo
+			}
+			return microseconds + float64(tick-lastTick)*float64(tempo)/float64(division)
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].tick < events[j].tick
+	})
+	ticksPerMicrosecond := float64(bpm) * float64(ticksPerBeat) / 60000000
+	for _, event := range events {
+		beat := int(microsecondsAt(event.tick)*ticksPerMicrosecond + 0.5)
+		if note, ok := FromMIDI(int(event.status), int(event.data1), int(event.data2), beat); ok {
+			m.AddNote(note)
+		}
+	}
+	return
+}
+
+// readChunk reads the type and the data of the next chunk
+func readChunk(r io.Reader) (chunkType string, data []byte, err error) {
+	header := make([]byte, 8)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return
+	}
+	chunkType = string(header[0:4])
+	// the data grows as it is read, so a length that is
+	// longer than the rest of the file is not allocated
+	var buf bytes.Buffer
+	_, err = io.CopyN(&buf, r, int64(binary.BigEndian.Uint32(header[4:8])))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	data = buf.Bytes()
+	return
+}
+
+// parseTrack reads the channel events and the tempo changes of a track,
+// following running status
+func parseTrack(data []byte) (events []midiEvent, tempos []tempoChange, err error) {
+	errTruncated := errors.New("truncated track")
+	tick := 0
+	runningStatus := byte(0)
+	i := 0
+	for i < len(data) {
+		delta, n := readVarint(data[i:])
+		if n == 0 {
+			return nil, nil, errTruncated
+		}
+		i += n
+		tick += delta
+		if i >= len(data) {
+			return nil, nil, errTruncated
+		}
+
+		status := data[i]
+		if status&0x80 != 0 {
+			i++
+		} else if runningStatus != 0 {
+			status = runningStatus
+		} else {
+			return nil, nil, errors.New("data byte without status")
+		}
+
+		switch {
+		case status == 0xFF:
+			// meta event, which cancels running status
+			runningStatus = 0
+			if i >= len(data) {
+				return nil, nil, errTruncated
+			}
+			metaType := data[i]
+			length, n := readVarint(data[i+1:])
+			if n == 0 || i+1+n+length > len(data) {
+				return nil, nil, errTruncated
+			}
+			meta := data[i+1+n : i+1+n+length]
+			i += 1 + n + length
+			if metaType == 0x51 && length == 3 {
+				tempos = append(tempos, tempoChange{
+					tick:  tick,
+					tempo: int(meta[0])<<16 | int(meta[1])<<8 | int(meta[2]),
+				})
+			} else if metaType == 0x2F {
+				return
+			}
+		case status == 0xF0 || status == 0xF7:
+			// system exclusive cancels running status
+			runningStatus = 0
+			length, n := readVarint(data[i:])
+			if n == 0 || i+n+length > len(data) {
+				return nil, nil, errTruncated
+			}
+			i += n + length
+		case status >= 0xF0:
+			return nil, nil, errors.New("unexpected system message in track")
+		default:
+			runningStatus = status
+			numData := 2
+			if status&0xF0 == 0xC0 || status&0xF0 == 0xD0 {
+				numData = 1
+			}
+			if i+numData > len(data) {
+				return nil, nil, errTruncated
+			}
+			event := midiEvent{tick: tick, status: status, data1: data[i]}
+			if numData == 2 {
+				event.data2 = data[i+1]
+			}
+			i += numData
+			events = append(events, event)
+		}
+	}
+	return
+}
+
+// readVarint reads a MIDI variable-length quantity, returning
+// the value and the number of bytes read (0 if truncated)
+func readVarint(data []byte) (value int, n int) {
+	for n < len(data) && n < 4 {
+		value = value<<7 | int(data[n]&0x7F)
+		n++
+		if data[n-1]&0x80 == 0 {
+			return
+		}
+	}
+	return 0, 0
+}
@@ -0,0 +1,189 @@
+package music
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestWriteMIDI(t *testing.T) {
+	m := New()
+	m.AddNote(Note{On: true, Pitch: 60, Velocity: 100, Beat: 0})
+	m.AddNote(Note{On: false, Pitch: 60, Velocity: 0, Beat: 250})
+	m.AddNote(Note{On: true, Pitch: 64, Velocity: 90, Beat: 250})
+	m.AddNote(Note{On: false, Pitch: 64, Velocity: 0, Beat: 500})
+
+	var buf bytes.Buffer
+	err := m.WriteMIDI(&buf, 120, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	if string(b[0:4]) != "MThd" {
+		t.Fatalf("bad header %q", b[0:4])
+	}
+	if format := binary.BigEndian.Uint16(b[8:10]); format != 1 {
+		t.Errorf("format %d, expected 1", format)
+	}
+	if tracks := binary.BigEndian.Uint16(b[10:12]); tracks != 2 {
+		t.Errorf("%d tracks, expected 2", tracks)
+	}
+	if division := binary.BigEndian.Uint16(b[12:14]); division != 250 {
+		t.Errorf("division %d, expected 250", division)
+	}
+	// tempo of 120 bpm is 500000 microseconds per beat
+	if !bytes.Contains(b, []byte{0xFF, 0x51, 0x03, 0x07, 0xA1, 0x20}) {
+		t.Error("missing tempo event")
+	}
+	// the note off of 60 comes before the note on of 64 at tick 250 (0x81 0x7A)
+	if !bytes.Contains(b, []byte{0x81, 0x7A, 0x80, 60, 0, 0x00, 0x90, 64, 90}) {
+		t.Errorf("unexpected note track % x", b)
+	}
+
+	if err = m.WriteMIDI(&buf, 0, 250); err == nil {
+		t.Error("expected error for zero bpm")
+	}
+}
+
+func TestReadMIDI(t *testing.T) {
+	m, err := Open("../testing/c_scale.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = m.WriteMIDI(&buf, 120, 250); err != nil {
+		t.Fatal(err)
+	}
+	m2, err := ReadMIDI(&buf, 120, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m2.GetAll()) != len(m.GetAll()) {
+		t.Fatalf("read %d notes, wrote %d", len(m2.GetAll()), len(m.GetAll()))
+	}
+	for _, note := range m.GetAll() {
+		_, notes := m2.Get(note.Beat)
+		found := false
+		for _, note2 := range notes {
+			if note2 == note {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("missing %+v", note)
+		}
+	}
+}
+
+func TestReadMIDITempoMap(t *testing.T) {
+	track := []byte{
+		// 96 ticks per beat at 120 bpm for one beat, then 60 bpm
+		0x00, 0x90, 60, 100,
+		0x60, 60, 0, // running status note on with zero velocity
+		0x00, 0xFF, 0x51, 0x03, 0x0F, 0x42, 0x40,
+		0x00, 0xF0, 0x02, 0x01, 0xF7, // sysex
+		0x00, 0x90, 62, 90,
+		0x60, 0x80, 62, 0,
+		0x00, 0xFF, 0x2F, 0x00,
+	}
+	var buf bytes.Buffer
+	buf.WriteString("MThd")
+	binary.Write(&buf, binary.BigEndian, []uint32{6})
+	binary.Write(&buf, binary.BigEndian, []uint16{0, 1, 96})
+	buf.WriteString("MTrk")
+	binary.Write(&buf, binary.BigEndian, uint32(len(track)))
+	buf.Write(track)
+
+	// 120 bpm with 100 ticks per beat: 200 ticks per second
+	m, err := ReadMIDI(&buf, 120, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Note{
+		{On: true, Pitch: 60, Velocity: 100, Beat: 0},
+		{On: false, Pitch: 60, Velocity: 0, Beat: 100},
+		{On: true, Pitch: 62, Velocity: 90, Beat: 100},
+		{On: false, Pitch: 62, Velocity: 0, Beat: 300},
+	}
+	for _, note := range expected {
+		_, notes := m.Get(note.Beat)
+		found := false
+		for _, note2 := range notes {
+			if note2 == note {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("missing %+v, got %+v", note, m.GetAll())
+		}
+	}
+}
+
+func TestReadMIDIBadFiles(t *testing.T) {
+	header := func(buf *bytes.Buffer) {
+		buf.WriteString("MThd")
+		binary.Write(buf, binary.BigEndian, []uint32{6})
+		binary.Write(buf, binary.BigEndian, []uint16{0, 1, 96})
+	}
+
+	// a meta event cancels running status
+	track := []byte{
+		0x00, 0x90, 60, 100,
+		0x00, 0xFF, 0x01, 0x01, 'a',
+		0x60, 60, 0,
+		0x00, 0xFF, 0x2F, 0x00,
+	}
+	var buf bytes.Buffer
+	header(&buf)
+	buf.WriteString("MTrk")
+	binary.Write(&buf, binary.BigEndian, uint32(len(track)))
+	buf.Write(track)
+	if _, err := ReadMIDI(&buf, 120, 100); err == nil {
+		t.Error("expected error for running status after a meta event")
+	}
+
+	// a track that claims to be longer than the file
+	buf.Reset()
+	header(&buf)
+	buf.WriteString("MTrk")
+	binary.Write(&buf, binary.BigEndian, uint32(0xFFFFFFF0))
+	buf.Write(track)
+	if _, err := ReadMIDI(&buf, 120, 100); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected unexpected EOF for a long track, got %v", err)
+	}
+}
+
+func TestControlEventsMIDI(t *testing.T) {
+	m := New()
+	m.AddNote(Note{Kind: ControlEvent, Pitch: SustainPedal, Velocity: 127, Beat: 0, Channel: 2})
+	m.AddNote(Note{On: true, Pitch: 60, Velocity: 100, Beat: 0, Channel: 2})
+	m.AddNote(Note{Kind: PitchBendEvent, Velocity: 10000, Beat: 5, Channel: 2})
+	m.AddNote(Note{On: false, Pitch: 60, Velocity: 40, Beat: 10, Channel: 2})
+	m.AddNote(Note{Kind: ControlEvent, Pitch: SustainPedal, Velocity: 0, Beat: 20, Channel: 2})
+
+	var buf bytes.Buffer
+	if err := m.WriteMIDI(&buf, 120, 100); err != nil {
+		t.Fatal(err)
+	}
+	m2, err := ReadMIDI(&buf, 120, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes, expected := m2.GetAll(), m.GetAll()
+	if len(notes) != len(expected) {
+		t.Fatalf("expected %+v, got %+v", expected, notes)
+	}
+	for i := range notes {
+		if notes[i] != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], notes[i])
+		}
+	}
+
+	if _, ok := FromMIDI(0xF8, 0, 0, 0); ok {
+		t.Error("clock should not be converted")
+	}
+	if note, _ := FromMIDI(0x91, 60, 0, 0); note.On || note.Channel != 1 {
+		t.Errorf("note on without velocity should be off, got %+v", note)
+	}
+}
@@ -4,23 +4,85 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"sort"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// Kind is the kind of MIDI event that a Note holds
+type Kind int
+
+const (
+	// NoteEvent is a key that is pressed (On) or released
+	NoteEvent Kind = iota
+	// ControlEvent is a control change, where the Pitch is the
+	// controller number and the Velocity is its value
+	ControlEvent
+	// PitchBendEvent is a pitch bend, where the Velocity is the
+	// 14-bit bend and PitchBendCenter is no bend
+	PitchBendEvent
+)
+
+// Controller numbers of the pedals
+const (
+	SustainPedal   = 64
+	SostenutoPedal = 66
+	SoftPedal      = 67
+)
+
+// PitchBendCenter is the value of a pitch bend that does not bend
+const PitchBendCenter = 8192
+
 // Note carries the pitch, velocity, and duration information
-// of a single press
+// of a single press. It can also carry a control change or a
+// pitch bend, see Kind.
 type Note struct {
 	On       bool
 	Pitch    int
 	Velocity int
 	Beat     int
+	// Kind of the event, which is a key by default
+	Kind Kind `json:",omitempty"`
+	// Channel is the MIDI channel (0-15)
+	Channel int `json:",omitempty"`
+}
+
+// IsNote returns whether the note is a key being pressed or released
+func (n *Note) IsNote() bool {
+	return n.Kind == NoteEvent
+}
+
+// IsPedalDown returns whether the note presses the sustain pedal
+func (n *Note) IsPedalDown() bool {
+	return n.Kind == ControlEvent && n.Pitch == SustainPedal && n.Velocity >= 64
+}
+
+// IsPedal returns whether the note is a change of one of the pedals
+func (n *Note) IsPedal() bool {
+	return n.Kind == ControlEvent && (n.Pitch == SustainPedal || n.Pitch == SostenutoPedal || n.Pitch == SoftPedal)
+}
+
+// IsRelease returns whether the note lets go of something, which is a
+// key that is released, a pedal that is lifted or a pitch bend that
+// goes back to the center
+func (n *Note) IsRelease() bool {
+	switch {
+	case n.IsNote():
+		return !n.On || n.Velocity == 0
+	case n.IsPedal():
+		return n.Velocity < 64
+	case n.Kind == PitchBendEvent:
+		return n.Velocity == PitchBendCenter
+	}
+	return false
 }
 
 // Time returns when it will be played (or turned off)
 func (n *Note) Time() string {
-	return fmt.Sprintf("%2.5f", n.Beat)
+	return fmt.Sprintf("%d", n.Beat)
 }
 
 func (n *Note) Name() string {
@@ -42,103 +104,423 @@ func (p Notes) Swap(i, j int) {
 	p[i], p[j] = p[j], p[i]
 }
 
+// FormatVersion is the version of the session files written by Save.
+// Version 1 stored the notes as a map of tick -> pitch -> note,
+// version 2 stores the list of events in the order they were played.
+const FormatVersion = 2
+
+// TimeSignature is the number of beats in a bar and the note value of a beat
+type TimeSignature struct {
+	Beats int
+	Unit  int
+}
+
+// Info describes how and where the music was recorded, which is
+// needed to interpret the ticks of the notes
+type Info struct {
+	// BPM is the tempo that the music was recorded at
+	BPM int
+	// TicksPerBeat is the resolution that the music was recorded at
+	TicksPerBeat int
+	// Key is the key of the song
+	Key string
+	// TimeSignature of the song
+	TimeSignature TimeSignature
+	// Device is the name of the MIDI device that was recorded
+	Device string
+	// Created is when the music was first recorded
+	Created time.Time
+}
+
 // Music stores all the notes that will be played / were already played
 type Music struct {
-	// Notes map: tick -> pitch -> note
-	Notes map[int]map[int]Note
+	Info
+	// events are all the notes in the order they were added
+	events []Note
+	// beats indexes the events: tick -> positions in events
+	beats map[int][]int
+	// ticks are the ticks of beats in ascending order
+	ticks []int
+	// journal receives every added note, if journaling
+	journal *journal
 	sync.RWMutex
 }
 
+// session is the format of the file written by Save
+type session struct {
+	Version int
+	Info
+	Notes []Note
+}
+
 // New returns a new object
 func New() *Music {
 	m := new(Music)
 	m.Lock()
-	m.Notes = make(map[int]map[int]Note)
+	m.events = []Note{}
+	m.beats = make(map[int][]int)
+	m.ticks = []int{}
+	m.TimeSignature = TimeSignature{4, 4}
+	m.Created = time.Now()
 	m.Unlock()
 	return m
 }
 
-// OpenMusic opens a previous music
-func Open(filename string) (*Music, error) {
+// Open opens a previous music, saved as JSON or in the binary format.
+// Files written by older versions are migrated. Legacy files, which only
+// contain the map of notes, have no Info except for the time they were
+// last modified. Notes in the journal of the file that were not saved
+// yet are recovered.
+func Open(filename string) (m *Music, err error) {
+	m = New()
+	m.Lock()
+	defer m.Unlock()
 	bMusic, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return new(Music), err
+	if err == nil {
+		err = m.decode(filename, bMusic)
 	}
-	m := new(Music)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	replayed, errJournal := m.replayJournal(JournalFile(filename))
+	if replayed > 0 {
+		log.WithFields(log.Fields{
+			"function": "Music.Open",
+		}).Infof("Recovered %d notes from %s", replayed, JournalFile(filename))
+		return m, nil
+	}
+	if err == nil && errJournal != nil && !os.IsNotExist(errJournal) {
+		err = errJournal
+	}
+	return
+}
+
+// OpenSaved opens a previous music like Open, but only reads what was
+// saved, leaving out the notes in the journal of the file
+func OpenSaved(filename string) (m *Music, err error) {
+	m = New()
 	m.Lock()
-	err = json.Unmarshal(bMusic, &m.Notes)
-	m.Unlock()
-	return m, err
+	defer m.Unlock()
+	bMusic, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	err = m.decode(filename, bMusic)
+	return
+}
+
+// load reads the contents of a JSON session file, the lock must be held
+func (m *Music) load(filename string, bMusic []byte) (err error) {
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(bMusic, &fields)
+	if err != nil {
+		return err
+	}
+	if _, isSession := fields["Version"]; !isSession {
+		var notesMap map[int]map[int]Note
+		err = json.Unmarshal(bMusic, &notesMap)
+		if err != nil {
+			return err
+		}
+		m.addNotesMap(notesMap)
+		m.Info = Info{TimeSignature: TimeSignature{4, 4}}
+		if stat, errStat := os.Stat(filename); errStat == nil {
+			m.Created = stat.ModTime()
+		}
+		return nil
+	}
+
+	var s struct {
+		Version int
+		Info
+		Notes json.RawMessage
+	}
+	err = json.Unmarshal(bMusic, &s)
+	if err != nil {
+		return err
+	}
+	if s.Version > FormatVersion {
+		return fmt.Errorf("%s has version %d, only versions up to %d are supported", filename, s.Version, FormatVersion)
+	}
+	m.Info = s.Info
+	if len(s.Notes) == 0 || string(s.Notes) == "null" {
+		return nil
+	}
+	if s.Version == 1 {
+		var notesMap map[int]map[int]Note
+		err = json.Unmarshal(s.Notes, &notesMap)
+		if err != nil {
+			return err
+		}
+		m.addNotesMap(notesMap)
+		return nil
+	}
+	var notes []Note
+	err = json.Unmarshal(s.Notes, &notes)
+	if err != nil {
+		return err
+	}
+	for _, note := range notes {
+		m.add(note)
+	}
+	return nil
+}
+
+// addNotesMap adds the notes of the tick -> pitch -> note map
+// used by older versions, ordered by tick and then by pitch.
+func (m *Music) addNotesMap(notesMap map[int]map[int]Note) {
+	beats := make([]int, 0, len(notesMap))
+	for beat := range notesMap {
+		beats = append(beats, beat)
+	}
+	sort.Ints(beats)
+	for _, beat := range beats {
+		pitches := make([]int, 0, len(notesMap[beat]))
+		for pitch := range notesMap[beat] {
+			pitches = append(pitches, pitch)
+		}
+		sort.Ints(pitches)
+		for _, pitch := range pitches {
+			m.add(notesMap[beat][pitch])
+		}
+	}
+}
+
+// add appends a note, the lock must be held
+func (m *Music) add(n Note) {
+	if _, hasBeat := m.beats[n.Beat]; !hasBeat {
+		// notes usually arrive in order, so the tick goes at the end
+		i := len(m.ticks)
+		if i > 0 && m.ticks[i-1] > n.Beat {
+			i = sort.SearchInts(m.ticks, n.Beat)
+		}
+		m.ticks = append(m.ticks, 0)
+		copy(m.ticks[i+1:], m.ticks[i:])
+		m.ticks[i] = n.Beat
+	}
+	m.beats[n.Beat] = append(m.beats[n.Beat], len(m.events))
+	m.events = append(m.events, n)
+}
+
+// notesAt returns the notes at a tick, the lock must be held
+func (m *Music) notesAt(beat int) (notes []Note) {
+	positions := m.beats[beat]
+	notes = make([]Note, len(positions))
+	for i, position := range positions {
+		notes[i] = m.events[position]
+	}
+	return
 }
 
-// AddNote will add a note in a thread-safe way.
+// AddNote will add a note in a thread-safe way. Every note is kept,
+// including several events for the same pitch on the same tick.
+// When journaling, the note is also written to the journal.
 func (m *Music) AddNote(n Note) (err error) {
 	m.Lock()
 	defer m.Unlock()
-	if _, hasTime := m.Notes[n.Beat]; hasTime {
-		if _, hasNote := m.Notes[n.Beat][n.Pitch]; hasNote {
-			return
-		}
-	} else {
-		m.Notes[n.Beat] = make(map[int]Note)
+	if m.journal != nil {
+		err = m.journal.write(len(m.events), n)
 	}
-	m.Notes[n.Beat][n.Pitch] = n
+	m.add(n)
 	return
 }
 
-// Get retrieve notes in music in a thread-safe way
+// Get retrieve notes in music in a thread-safe way, in
+// the order they were added
 func (m *Music) Get(beat int) (hasNotes bool, notes []Note) {
 	m.RLock()
 	defer m.RUnlock()
-	var notesMap map[int]Note
-	notesMap, hasNotes = m.Notes[beat]
-	if !hasNotes {
+	if _, hasNotes = m.beats[beat]; !hasNotes {
 		return
 	}
-	notes = make([]Note, len(notesMap))
-	i := 0
-	for _, note := range notesMap {
-		notes[i] = note
-		i++
-	}
+	notes = m.notesAt(beat)
 	return
 }
 
 // HasFuture returns whether there are future beats in the registry
 func (m *Music) HasFuture(currentBeat int) bool {
-	m.RLock()
-	defer m.RUnlock()
-	for beat := range m.Notes {
-		if beat > currentBeat {
-			return true
-		}
-	}
-	return false
+	last, ok := m.Last()
+	return ok && last > currentBeat
 }
 
-// GetAll retrieve notes in music in a thread-safe way
+// GetAll retrieve notes in music in a thread-safe way, ordered
+// by tick and then in the order they were added
 func (m *Music) GetAll() (notes []Note) {
 	logger := log.WithFields(log.Fields{
 		"function": "Music.GetAllNotes",
 	})
 	logger.Debug("Getting all")
+	m.RLock()
+	defer m.RUnlock()
+	notes = make([]Note, 0, len(m.events))
+	for _, beat := range m.ticks {
+		notes = append(notes, m.notesAt(beat)...)
+	}
+	return
+}
+
+// Range returns the notes from the tick from up to, but not
+// including, the tick to, ordered like GetAll
+func (m *Music) Range(from, to int) (notes []Note) {
 	m.RLock()
 	defer m.RUnlock()
 	notes = []Note{}
-	for beat := range m.Notes {
-		for pitch := range m.Notes[beat] {
-			notes = append(notes, m.Notes[beat][pitch])
+	for i := sort.SearchInts(m.ticks, from); i < len(m.ticks) && m.ticks[i] < to; i++ {
+		notes = append(notes, m.notesAt(m.ticks[i])...)
+	}
+	return
+}
+
+// Next returns the first tick after the given tick that
+// has notes, and its notes
+func (m *Music) Next(after int) (beat int, notes []Note, ok bool) {
+	m.RLock()
+	defer m.RUnlock()
+	i := sort.SearchInts(m.ticks, after+1)
+	if i == len(m.ticks) {
+		return
+	}
+	beat = m.ticks[i]
+	notes = m.notesAt(beat)
+	ok = true
+	return
+}
+
+// First returns the first tick that has notes
+func (m *Music) First() (beat int, ok bool) {
+	m.RLock()
+	defer m.RUnlock()
+	if len(m.ticks) == 0 {
+		return
+	}
+	return m.ticks[0], true
+}
+
+// Last returns the last tick that has notes
+func (m *Music) Last() (beat int, ok bool) {
+	m.RLock()
+	defer m.RUnlock()
+	if len(m.ticks) == 0 {
+		return
+	}
+	return m.ticks[len(m.ticks)-1], true
+}
+
+// Each calls the function for every note, ordered like GetAll,
+// until the function returns false. The music must not be
+// changed from within the function.
+func (m *Music) Each(f func(note Note) bool) {
+	m.RLock()
+	defer m.RUnlock()
+	for _, beat := range m.ticks {
+		for _, position := range m.beats[beat] {
+			if !f(m.events[position]) {
+				return
+			}
 		}
 	}
+}
+
+// Clear removes every note, keeping the Info. It is meant for music
+// that is not journaled, like the notes that are waiting to be played.
+func (m *Music) Clear() {
+	m.Lock()
+	defer m.Unlock()
+	m.events = []Note{}
+	m.beats = make(map[int][]int)
+	m.ticks = []int{}
+}
+
+// Truncate keeps the first n notes that were added, and removes the
+// rest. When journaling, the music is saved like Compact does, so
+// the removed notes are not recovered from the journal.
+func (m *Music) Truncate(n int) (err error) {
+	m.Lock()
+	defer m.Unlock()
+	if n < 0 {
+		n = 0
+	}
+	if n >= len(m.events) {
+		return
+	}
+	kept := m.events[:n]
+	m.events = []Note{}
+	m.beats = make(map[int][]int)
+	m.ticks = []int{}
+	for _, note := range kept {
+		m.add(note)
+	}
+	if m.journal == nil {
+		return
+	}
+	err = m.save(m.journal.session)
+	if err != nil {
+		return
+	}
+	return m.journal.truncate()
+}
+
+// Len returns the number of notes
+func (m *Music) Len() int {
+	m.RLock()
+	defer m.RUnlock()
+	return len(m.events)
+}
+
+// Beats returns the sorted ticks that have notes
+func (m *Music) Beats() (beats []int) {
+	m.RLock()
+	defer m.RUnlock()
+	beats = make([]int, len(m.ticks))
+	copy(beats, m.ticks)
 	return
 }
 
+// Notes returns the notes as a map of tick -> pitch -> note, which was
+// the Notes field before every event was kept. A later note at the same
+// tick and pitch replaces an earlier one, and control changes and pitch
+// bends are left out.
+//
+// Deprecated: use Get, Range or Each, which return every event.
+func (m *Music) Notes() (notes map[int]map[int]Note) {
+	m.RLock()
+	defer m.RUnlock()
+	notes = make(map[int]map[int]Note)
+	for _, note := range m.events {
+		if !note.IsNote() {
+			continue
+		}
+		if _, ok := notes[note.Beat]; !ok {
+			notes[note.Beat] = make(map[int]Note)
+		}
+		notes[note.Beat][note.Pitch] = note
+	}
+	return
+}
+
+// Save writes the music and its Info to a versioned session file. Files
+// with the BinaryExtension are saved in the compact binary format, and
+// files ending with ".gz" are gzipped.
 func (m *Music) Save(filename string) (err error) {
 	m.RLock()
 	defer m.RUnlock()
-	bMusic, err := json.Marshal(m.Notes)
+	return m.save(filename)
+}
+
+// save writes the session file, the lock must be held
+func (m *Music) save(filename string) (err error) {
+	bMusic, err := m.encode(filename)
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(filename, bMusic, 0755)
+	return writeFileAtomic(filename, bMusic, 0755)
+}
+
+// marshalJSON encodes the session as JSON, the lock must be held
+func (m *Music) marshalJSON() ([]byte, error) {
+	return json.Marshal(session{
+		Version: FormatVersion,
+		Info:    m.Info,
+		Notes:   m.events,
+	})
 }
@@ -0,0 +1,324 @@
+package music
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenLegacy(t *testing.T) {
+	m, err := Open("../testing/c_scale.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.GetAll()) == 0 {
+		t.Error("no notes loaded")
+	}
+	if m.TicksPerBeat != 0 || m.BPM != 0 {
+		t.Errorf("legacy file should have no tempo, got %+v", m.Info)
+	}
+	if m.Created.IsZero() {
+		t.Error("legacy file should use modification time")
+	}
+}
+
+func TestSaveOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "music")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "session.json")
+
+	m := New()
+	m.BPM = 90
+	m.TicksPerBeat = 333
+	m.Key = "Em"
+	m.TimeSignature = TimeSignature{3, 4}
+	m.Device = "Digital Piano"
+	m.AddNote(Note{On: true, Pitch: 64, Velocity: 80, Beat: 10})
+	m.AddNote(Note{On: false, Pitch: 64, Velocity: 0, Beat: 100})
+	if err = m.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	m2, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m2.BPM != 90 || m2.TicksPerBeat != 333 || m2.Key != "Em" || m2.TimeSignature != (TimeSignature{3, 4}) || m2.Device != "Digital Piano" {
+		t.Errorf("info not preserved: %+v", m2.Info)
+	}
+	if !m2.Created.Equal(m.Created) {
+		t.Errorf("created %s, expected %s", m2.Created, m.Created)
+	}
+	if len(m2.GetAll()) != 2 {
+		t.Errorf("expected 2 notes, got %+v", m2.GetAll())
+	}
+
+	ioutil.WriteFile(filename, []byte(`{"Version":1000,"Notes":{}}`), 0644)
+	if _, err = Open(filename); err == nil {
+		t.Error("expected error for unsupported version")
+	}
+}
+
+func TestRescale(t *testing.T) {
+	m := New()
+	m.BPM = 90
+	m.TicksPerBeat = 300
+	m.AddNote(Note{On: true, Pitch: 64, Velocity: 80, Beat: 300})
+	m.AddNote(Note{On: false, Pitch: 64, Velocity: 0, Beat: 450})
+	m2 := m.Rescale(100)
+	if m2.TicksPerBeat != 100 || m2.BPM != 90 {
+		t.Errorf("bad info %+v", m2.Info)
+	}
+	if hasNotes, _ := m2.Get(100); !hasNotes {
+		t.Error("missing note at 100")
+	}
+	if hasNotes, _ := m2.Get(150); !hasNotes {
+		t.Error("missing note at 150")
+	}
+}
+
+func TestAddNoteKeepsEveryEvent(t *testing.T) {
+	m := New()
+	m.AddNote(Note{On: true, Pitch: 60, Velocity: 80, Beat: 0})
+	m.AddNote(Note{On: false, Pitch: 60, Velocity: 0, Beat: 10})
+	m.AddNote(Note{On: true, Pitch: 60, Velocity: 90, Beat: 10})
+	m.AddNote(Note{On: true, Pitch: 60, Velocity: 90, Beat: 10})
+	hasNotes, notes := m.Get(10)
+	if !hasNotes || len(notes) != 3 {
+		t.Fatalf("expected 3 notes, got %+v", notes)
+	}
+	if notes[0].On || !notes[1].On {
+		t.Errorf("order not preserved: %+v", notes)
+	}
+	if m.Len() != 4 || len(m.GetAll()) != 4 {
+		t.Errorf("expected 4 notes, got %d", m.Len())
+	}
+	if !m.HasFuture(5) || m.HasFuture(10) {
+		t.Error("bad HasFuture")
+	}
+	if beats := m.Beats(); len(beats) != 2 || beats[0] != 0 || beats[1] != 10 {
+		t.Errorf("bad beats %+v", beats)
+	}
+	// the old map keeps the last event of a pitch on a tick
+	if notes := m.Notes(); len(notes) != 2 || !notes[10][60].On || notes[0][60].Velocity != 80 {
+		t.Errorf("bad notes map %+v", notes)
+	}
+}
+
+func TestOpenVersion1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "music")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "session.json")
+	ioutil.WriteFile(filename, []byte(`{"Version":1,"BPM":120,"TicksPerBeat":250,"Notes":{"5":{"64":{"On":false,"Pitch":64,"Velocity":0,"Beat":5},"62":{"On":true,"Pitch":62,"Velocity":70,"Beat":5}},"0":{"64":{"On":true,"Pitch":64,"Velocity":70,"Beat":0}}}}`), 0644)
+	m, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes := m.GetAll()
+	if len(notes) != 3 || notes[0].Beat != 0 || notes[1].Pitch != 62 || notes[2].Pitch != 64 {
+		t.Errorf("bad migration %+v", notes)
+	}
+	if m.TicksPerBeat != 250 {
+		t.Errorf("bad info %+v", m.Info)
+	}
+}
+
+func TestRangeQueries(t *testing.T) {
+	m := New()
+	if _, ok := m.Last(); ok {
+		t.Error("empty music should have no last tick")
+	}
+	for _, beat := range []int{40, 10, 30, 10, 20, 50} {
+		m.AddNote(Note{On: true, Pitch: 60 + beat/10, Velocity: beat, Beat: beat})
+	}
+	if beats := m.Beats(); len(beats) != 5 || beats[0] != 10 || beats[4] != 50 {
+		t.Errorf("bad beats %+v", beats)
+	}
+	notes := m.Range(10, 40)
+	if len(notes) != 4 || notes[0].Beat != 10 || notes[1].Beat != 10 || notes[3].Beat != 30 {
+		t.Errorf("bad range %+v", notes)
+	}
+	if beat, notes, ok := m.Next(20); !ok || beat != 30 || len(notes) != 1 {
+		t.Errorf("bad next %d %+v", beat, notes)
+	}
+	if _, _, ok := m.Next(50); ok {
+		t.Error("nothing should be after 50")
+	}
+	if first, ok := m.First(); !ok || first != 10 {
+		t.Errorf("bad first %d", first)
+	}
+	if last, ok := m.Last(); !ok || last != 50 {
+		t.Errorf("bad last %d", last)
+	}
+	previous := 0
+	count := 0
+	m.Each(func(note Note) bool {
+		if note.Beat < previous {
+			t.Errorf("out of order %+v", note)
+		}
+		previous = note.Beat
+		count++
+		return note.Beat < 30
+	})
+	if count != 4 {
+		t.Errorf("iteration did not stop, %d notes", count)
+	}
+	notes = m.GetAll()
+	for i := 1; i < len(notes); i++ {
+		if notes[i].Beat < notes[i-1].Beat {
+			t.Errorf("GetAll out of order %+v", notes)
+		}
+	}
+}
+
+func TestClear(t *testing.T) {
+	m := New()
+	m.BPM = 90
+	m.AddNote(Note{On: true, Pitch: 60, Velocity: 80, Beat: 10})
+	m.AddNote(Note{On: false, Pitch: 60, Velocity: 0, Beat: 20})
+	m.Clear()
+	if m.Len() != 0 || m.HasFuture(0) {
+		t.Errorf("music still has %d notes", m.Len())
+	}
+	if m.BPM != 90 {
+		t.Error("info was not kept")
+	}
+	m.AddNote(Note{On: true, Pitch: 62, Velocity: 80, Beat: 5})
+	if has, notes := m.Get(5); !has || len(notes) != 1 {
+		t.Errorf("note after clearing is %+v", notes)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "music")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "session.json")
+
+	m := New()
+	if err = m.StartJournal(filename); err != nil {
+		t.Fatal(err)
+	}
+	m.AddNote(Note{On: true, Pitch: 60, Velocity: 80, Beat: 10})
+	m.AddNote(Note{On: false, Pitch: 60, Velocity: 0, Beat: 20})
+	// added out of order, and on a tick that is kept
+	m.AddNote(Note{On: true, Pitch: 62, Velocity: 80, Beat: 5})
+	m.AddNote(Note{On: false, Pitch: 62, Velocity: 0, Beat: 10})
+	if err = m.Truncate(2); err != nil {
+		t.Fatal(err)
+	}
+	if notes := m.GetAll(); len(notes) != 2 || notes[0].Pitch != 60 || notes[1].Beat != 20 {
+		t.Errorf("kept %+v", notes)
+	}
+	if first, _ := m.First(); first != 10 {
+		t.Errorf("first tick is %d", first)
+	}
+	m.StopJournal()
+
+	// the removed notes are not recovered
+	m2, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m2.Len() != 2 {
+		t.Errorf("expected 2 notes, got %+v", m2.GetAll())
+	}
+}
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "music")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "session.json")
+
+	m := New()
+	if err = m.StartJournal(filename); err != nil {
+		t.Fatal(err)
+	}
+	m.AddNote(Note{On: true, Pitch: 60, Velocity: 80, Beat: 0})
+	if err = m.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	m.AddNote(Note{On: false, Pitch: 60, Velocity: 0, Beat: 10})
+	m.AddNote(Note{On: true, Pitch: 62, Velocity: 80, Beat: 10})
+	if err = m.StopJournal(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash while writing leaves a partial line
+	f, _ := os.OpenFile(JournalFile(filename), os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString(`{"Seq":3,"Note":{"On":fa`)
+	f.Close()
+
+	m2, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notes := m2.GetAll(); len(notes) != 3 || notes[2].Pitch != 62 {
+		t.Errorf("bad replay %+v", notes)
+	}
+	saved, err := OpenSaved(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Len() != 1 {
+		t.Errorf("journal replayed when opening what was saved: %+v", saved.GetAll())
+	}
+
+	// notes that were compacted but still in the journal are not replayed twice
+	m2.StartJournal(filename)
+	m2.Save(filename)
+	m2.AddNote(Note{On: false, Pitch: 62, Velocity: 0, Beat: 20})
+	m2.StopJournal()
+	m3, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m3.Len() != 4 {
+		t.Errorf("expected 4 notes, got %+v", m3.GetAll())
+	}
+
+	// the journal is enough when the session file was never written
+	filename = filepath.Join(dir, "unsaved.json")
+	m4 := New()
+	m4.StartJournal(filename)
+	m4.AddNote(Note{On: true, Pitch: 60, Velocity: 80, Beat: 0})
+	m4.StopJournal()
+	if m4, err = Open(filename); err != nil || m4.Len() != 1 {
+		t.Errorf("journal not replayed without session: %v", err)
+	}
+}
+
+func TestIsRelease(t *testing.T) {
+	tests := []struct {
+		note    Note
+		release bool
+	}{
+		{Note{On: true, Pitch: 60, Velocity: 100}, false},
+		{Note{On: false, Pitch: 60}, true},
+		{Note{On: true, Pitch: 60, Velocity: 0}, true},
+		{Note{Kind: ControlEvent, Pitch: SustainPedal, Velocity: 127}, false},
+		{Note{Kind: ControlEvent, Pitch: SustainPedal, Velocity: 0}, true},
+		{Note{Kind: ControlEvent, Pitch: SoftPedal, Velocity: 63}, true},
+		// other controls do not go back to a rest
+		{Note{Kind: ControlEvent, Pitch: 1, Velocity: 0}, false},
+		{Note{Kind: PitchBendEvent, Velocity: PitchBendCenter}, true},
+		{Note{Kind: PitchBendEvent, Velocity: 0}, false},
+	}
+	for _, test := range tests {
+		if release := test.note.IsRelease(); release != test.release {
+			t.Errorf("%+v releases is %v", test.note, release)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package music
+
+import "sort"
+
+// Span is a note from when it is pressed until it is released
+type Span struct {
+	Pitch    int
+	Velocity int
+	Channel  int
+	// Start is the tick of the note on
+	Start int
+	// Duration is the number of ticks until the note off
+	Duration int
+	// ReleaseVelocity is the velocity of the note off
+	ReleaseVelocity int
+	// Sounding is the number of ticks that the note is heard, which is
+	// longer than the Duration when the sustain pedal holds the note
+	Sounding int
+	// Gap is the number of ticks until the next later note on,
+	// or 0 if no note is pressed afterwards
+	Gap int
+	// Unterminated is set when the note is never turned off,
+	// in which case it lasts until the last note of the music
+	Unterminated bool
+}
+
+// Spans pairs the note ons with the note offs of the music,
+// see Spans
+func (m *Music) Spans() []Span {
+	return Spans(m.GetAll())
+}
+
+// Spans pairs every note on with the note off of the same pitch and
+// channel, in a single pass. When the same pitch is pressed again before
+// it is released, the earliest note is released first. A note released
+// while the sustain pedal is down keeps sounding until the pedal is
+// released or the key is pressed again. The spans are ordered by
+// their start.
+func Spans(notes []Note) (spans []Span) {
+	ordered := Notes(notes)
+	if !sort.IsSorted(ordered) {
+		ordered = make(Notes, len(notes))
+		copy(ordered, notes)
+		sort.Stable(ordered)
+	}
+
+	spans = []Span{}
+	// pressed keeps the spans that are not yet released: key -> positions
+	pressed := make(map[[2]int][]int)
+	// pedal is whether the sustain pedal of a channel is down
+	pedal := make(map[int]bool)
+	// sustained keeps the released spans held by the pedal of a channel
+	sustained := make(map[int][]int)
+	for _, note := range ordered {
+		if note.Kind == ControlEvent && note.Pitch == SustainPedal {
+			pedal[note.Channel] = note.IsPedalDown()
+			if !pedal[note.Channel] {
+				for _, i := range sustained[note.Channel] {
+					spans[i].Sounding = note.Beat - spans[i].Start
+				}
+				sustained[note.Channel] = nil
+			}
+			continue
+		}
+		if !note.IsNote() {
+			continue
+		}
+		key := [2]int{note.Channel, note.Pitch}
+		if note.On {
+			// pressing a key again stops it from ringing
+			held := sustained[note.Channel][:0]
+			for _, i := range sustained[note.Channel] {
+				if spans[i].Pitch == note.Pitch {
+					spans[i].Sounding = note.Beat - spans[i].Start
+				} else {
+					held = append(held, i)
+				}
+			}
+			sustained[note.Channel] = held
+			pressed[key] = append(pressed[key], len(spans))
+			spans = append(spans, Span{
+				Pitch:    note.Pitch,
+				Velocity: note.Velocity,
+				Channel:  note.Channel,
+				Start:    note.Beat,
+			})
+			continue
+		}
+		if len(pressed[key]) == 0 {
+			// released without being pressed
+			continue
+		}
+		i := pressed[key][0]
+		pressed[key] = pressed[key][1:]
+		spans[i].Duration = note.Beat - spans[i].Start
+		spans[i].Sounding = spans[i].Duration
+		spans[i].ReleaseVelocity = note.Velocity
+		if pedal[note.Channel] {
+			sustained[note.Channel] = append(sustained[note.Channel], i)
+		}
+	}
+
+	if len(ordered) > 0 {
+		last := ordered[len(ordered)-1].Beat
+		for _, positions := range pressed {
+			for _, i := range positions {
+				spans[i].Duration = last - spans[i].Start
+				spans[i].Sounding = spans[i].Duration
+				spans[i].Unterminated = true
+			}
+		}
+		for _, positions := range sustained {
+			for _, i := range positions {
+				spans[i].Sounding = last - spans[i].Start
+			}
+		}
+	}
+
+	// the gap is to the next note that starts later
+	hasNext := false
+	next := 0
+	for i := len(spans) - 1; i >= 0; i-- {
+		if i+1 < len(spans) && spans[i+1].Start > spans[i].Start {
+			hasNext = true
+			next = spans[i+1].Start
+		}
+		if hasNext {
+			spans[i].Gap = next - spans[i].Start
+		}
+	}
+	return
+}
@@ -0,0 +1,75 @@
+package music
+
+import "testing"
+
+func TestSpans(t *testing.T) {
+	m := New()
+	m.AddNote(Note{On: true, Pitch: 60, Velocity: 80, Beat: 0})
+	m.AddNote(Note{On: true, Pitch: 64, Velocity: 70, Beat: 0})
+	// 60 is pressed again before it is released
+	m.AddNote(Note{On: true, Pitch: 60, Velocity: 90, Beat: 10})
+	m.AddNote(Note{On: false, Pitch: 60, Velocity: 30, Beat: 20})
+	m.AddNote(Note{On: false, Pitch: 64, Velocity: 0, Beat: 25})
+	m.AddNote(Note{On: false, Pitch: 60, Velocity: 0, Beat: 30})
+	// released without being pressed
+	m.AddNote(Note{On: false, Pitch: 50, Velocity: 0, Beat: 35})
+	// never released
+	m.AddNote(Note{On: true, Pitch: 67, Velocity: 60, Beat: 40})
+	m.AddNote(Note{On: true, Pitch: 72, Velocity: 60, Beat: 45})
+	m.AddNote(Note{On: false, Pitch: 72, Velocity: 0, Beat: 50})
+
+	expected := []Span{
+		{Pitch: 60, Velocity: 80, Start: 0, Duration: 20, Sounding: 20, ReleaseVelocity: 30, Gap: 10},
+		{Pitch: 64, Velocity: 70, Start: 0, Duration: 25, Sounding: 25, Gap: 10},
+		{Pitch: 60, Velocity: 90, Start: 10, Duration: 20, Sounding: 20, Gap: 30},
+		{Pitch: 67, Velocity: 60, Start: 40, Duration: 10, Sounding: 10, Gap: 5, Unterminated: true},
+		{Pitch: 72, Velocity: 60, Start: 45, Duration: 5, Sounding: 5},
+	}
+	spans := m.Spans()
+	if len(spans) != len(expected) {
+		t.Fatalf("expected %d spans, got %+v", len(expected), spans)
+	}
+	for i := range spans {
+		if spans[i] != expected[i] {
+			t.Errorf("span %d: expected %+v, got %+v", i, expected[i], spans[i])
+		}
+	}
+
+	// unordered notes are sorted first
+	notes := m.GetAll()
+	notes[0], notes[len(notes)-1] = notes[len(notes)-1], notes[0]
+	if spans = Spans(notes); len(spans) != len(expected) || spans[0].Start != 0 {
+		t.Errorf("bad spans of unordered notes %+v", spans)
+	}
+}
+
+func TestSpansSustainPedal(t *testing.T) {
+	m := New()
+	m.AddNote(Note{Kind: ControlEvent, Pitch: SustainPedal, Velocity: 127, Beat: 0})
+	m.AddNote(Note{On: true, Pitch: 60, Velocity: 80, Beat: 0})
+	m.AddNote(Note{On: false, Pitch: 60, Velocity: 0, Beat: 10})
+	m.AddNote(Note{On: true, Pitch: 64, Velocity: 80, Beat: 10})
+	m.AddNote(Note{On: false, Pitch: 64, Velocity: 0, Beat: 20})
+	// 64 is pressed again while it is still ringing
+	m.AddNote(Note{On: true, Pitch: 64, Velocity: 80, Beat: 30})
+	m.AddNote(Note{Kind: PitchBendEvent, Velocity: PitchBendCenter, Beat: 35})
+	m.AddNote(Note{Kind: ControlEvent, Pitch: SustainPedal, Velocity: 0, Beat: 50})
+	m.AddNote(Note{On: false, Pitch: 64, Velocity: 0, Beat: 60})
+	// other channels have their own pedal
+	m.AddNote(Note{On: true, Pitch: 67, Velocity: 80, Beat: 60, Channel: 1})
+	m.AddNote(Note{On: false, Pitch: 67, Velocity: 0, Beat: 70, Channel: 1})
+
+	spans := m.Spans()
+	if len(spans) != 4 {
+		t.Fatalf("expected 4 spans, got %+v", spans)
+	}
+	expected := []struct{ duration, sounding int }{{10, 50}, {10, 20}, {30, 30}, {10, 10}}
+	for i := range expected {
+		if spans[i].Duration != expected[i].duration || spans[i].Sounding != expected[i].sounding {
+			t.Errorf("span %d: expected %+v, got %+v", i, expected[i], spans[i])
+		}
+	}
+	if spans[3].Channel != 1 {
+		t.Errorf("bad channel %+v", spans[3])
+	}
+}
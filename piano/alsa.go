@@ -0,0 +1,235 @@
+//go:build linux
+// +build linux
+
+package piano
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	registerBackend(Backend{
+		Name:    "alsa",
+		List:    ListALSA,
+		Plugged: ListALSA,
+		New: func(input, output string) Device {
+			return NewALSA(input, output)
+		},
+	})
+}
+
+// ALSA is a device connected through the raw MIDI ports of the
+// Linux sound system (/dev/snd/midiC*D*), without any C library
+type ALSA struct {
+	// Input and Output select the ports by name, like PortMIDI
+	Input  string
+	Output string
+
+	input      alsaPort
+	output     alsaPort
+	inputFile  *os.File
+	outputFile *os.File
+	events     chan Event
+	done       chan bool
+	stopped    chan bool
+	start      time.Time
+	sync.Mutex
+}
+
+// alsaPort is a raw MIDI port and its device file
+type alsaPort struct {
+	DeviceInfo
+	path string
+}
+
+// NewALSA returns an ALSA device, with the input and
+// output ports that match the names (see PortMIDI)
+func NewALSA(input, output string) *ALSA {
+	return &ALSA{Input: input, Output: output}
+}
+
+// ListALSA returns the raw MIDI ports of the system
+func ListALSA() (devices []DeviceInfo, err error) {
+	ports, err := alsaPorts()
+	for _, port := range ports {
+		devices = append(devices, port.DeviceInfo)
+	}
+	return
+}
+
+// alsaPorts finds the raw MIDI ports, with their names and
+// directions from /proc/asound
+func alsaPorts() (ports []alsaPort, err error) {
+	paths, err := filepath.Glob("/dev/snd/midiC*D*")
+	if err != nil {
+		return
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		var card, device int
+		_, err = fmt.Sscanf(filepath.Base(path), "midiC%dD%d", &card, &device)
+		if err != nil {
+			err = nil
+			continue
+		}
+		port := alsaPort{
+			DeviceInfo: DeviceInfo{
+				ID:        len(ports),
+				Name:      filepath.Base(path),
+				Interface: "ALSA",
+				Input:     true,
+				Output:    true,
+			},
+			path: path,
+		}
+		// the first line is the name, followed by the
+		// input and output substreams
+		info, errInfo := ioutil.ReadFile(fmt.Sprintf("/proc/asound/card%d/midi%d", card, device))
+		if errInfo == nil {
+			lines := strings.Split(string(info), "\n")
+			if name := strings.TrimSpace(lines[0]); name != "" {
+				port.Name = name
+			}
+			port.Input, port.Output = false, false
+			for _, line := range lines[1:] {
+				if strings.HasPrefix(line, "Input") {
+					port.Input = true
+				} else if strings.HasPrefix(line, "Output") {
+					port.Output = true
+				}
+			}
+		}
+		ports = append(ports, port)
+	}
+	return
+}
+
+// Open finds the device ports and opens them
+func (d *ALSA) Open() (err error) {
+	logger := log.WithFields(log.Fields{
+		"function": "ALSA.Open",
+	})
+	ports, err := alsaPorts()
+	if err != nil {
+		return
+	}
+	devices := make([]DeviceInfo, len(ports))
+	for i, port := range ports {
+		devices[i] = port.DeviceInfo
+		logger.Debug(port.String())
+	}
+	input, err := selectDevice(devices, d.Input, true)
+	if err != nil {
+		return
+	}
+	output, err := selectDevice(devices, d.Output, false)
+	if err != nil {
+		return
+	}
+	d.input, d.output = ports[input.ID], ports[output.ID]
+	logger.Infof("Using input %s and output %s", d.input, d.output)
+
+	// the input does not block, so that closing it stops the reader
+	d.inputFile, err = os.OpenFile(d.input.path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return
+	}
+	d.outputFile, err = os.OpenFile(d.output.path, os.O_WRONLY, 0)
+	if err != nil {
+		d.inputFile.Close()
+		return
+	}
+	d.start = time.Now()
+	d.events = make(chan Event, 1024)
+	d.done = make(chan bool)
+	d.stopped = make(chan bool)
+	go d.read()
+	return
+}
+
+// read parses the input until the device is closed, also
+// when nobody reads its events
+func (d *ALSA) read() {
+	defer close(d.stopped)
+	defer close(d.events)
+	var parser midiParser
+	buf := make([]byte, 1024)
+	for {
+		n, err := d.inputFile.Read(buf)
+		timestamp := int64(time.Since(d.start) / time.Millisecond)
+		for _, b := range buf[:n] {
+			if event, ok := parser.parse(b); ok {
+				event.Timestamp = timestamp
+				select {
+				case d.events <- event:
+				case <-d.done:
+					return
+				}
+			}
+		}
+		if err != nil {
+			if pathErr, ok := err.(*os.PathError); !ok || pathErr.Err != os.ErrClosed {
+				log.WithFields(log.Fields{
+					"function": "ALSA.read",
+				}).Error(err.Error())
+			}
+			return
+		}
+	}
+}
+
+// Listen returns the events of the input port
+func (d *ALSA) Listen() <-chan Event {
+	return d.events
+}
+
+// Write sends the events to the output port right away
+func (d *ALSA) Write(events []Event) (err error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.outputFile == nil {
+		return errors.New("ALSA device is not open")
+	}
+	_, err = d.outputFile.Write(midiBytes(events))
+	return
+}
+
+// InputName returns the name of the input port
+func (d *ALSA) InputName() string {
+	return d.input.Name
+}
+
+// Close stops reading and closes the ports
+func (d *ALSA) Close() (err error) {
+	logger := log.WithFields(log.Fields{
+		"function": "ALSA.Close",
+	})
+	if d.inputFile != nil {
+		logger.Debug("Closing input")
+		close(d.done)
+		err = d.inputFile.Close()
+		<-d.stopped
+		d.inputFile = nil
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.outputFile != nil {
+		logger.Debug("Closing output")
+		if errClose := d.outputFile.Close(); errClose != nil {
+			err = errClose
+		}
+		d.outputFile = nil
+	}
+	return
+}
@@ -0,0 +1,79 @@
+package piano
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Backend is a library or driver that connects to MIDI devices
+type Backend struct {
+	// Name is used to select the backend
+	Name string
+	// List returns the ports of the system
+	List func() ([]DeviceInfo, error)
+	// Plugged, when set, returns the ports that are plugged in right
+	// now, also while a device of the backend is open, so that the
+	// Watcher notices when the port of its device is unplugged
+	Plugged func() ([]DeviceInfo, error)
+	// New returns a device with the input and output ports that
+	// match the names, like PortMIDI
+	New func(input, output string) Device
+}
+
+// backends are the backends compiled in, by name
+var backends = make(map[string]Backend)
+
+// defaultBackends are tried in order when no backend is chosen
+var defaultBackends = []string{"portmidi", "alsa"}
+
+// registerBackend makes a backend available, it is called in init
+func registerBackend(backend Backend) {
+	backends[backend.Name] = backend
+}
+
+// Backends returns the names of the backends compiled in
+func Backends() (names []string) {
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// getBackend returns the backend with the name, or
+// the default backend when the name is empty
+func getBackend(name string) (backend Backend, err error) {
+	if name == "" {
+		for _, name := range defaultBackends {
+			if backend, ok := backends[name]; ok {
+				return backend, nil
+			}
+		}
+	}
+	backend, ok := backends[name]
+	if !ok {
+		err = fmt.Errorf("MIDI backend %q is not available, choose from: %s", name, strings.Join(Backends(), ", "))
+	}
+	return
+}
+
+// ListDevices returns the ports that the backend can use
+func ListDevices(backendName string) (devices []DeviceInfo, err error) {
+	backend, err := getBackend(backendName)
+	if err != nil {
+		return
+	}
+	return backend.List()
+}
+
+// NewDevice returns a device of the backend, with the input and
+// output ports that match the names. The default backend is used
+// when the name of the backend is empty.
+func NewDevice(backendName, input, output string) (device Device, err error) {
+	backend, err := getBackend(backendName)
+	if err != nil {
+		return
+	}
+	return backend.New(input, output), nil
+}
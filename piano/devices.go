@@ -0,0 +1,85 @@
+package piano
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DeviceInfo describes a MIDI port of the system
+type DeviceInfo struct {
+	ID        int
+	Name      string
+	Interface string
+	Input     bool
+	Output    bool
+}
+
+// String returns the ID, direction and name of the port
+func (info DeviceInfo) String() string {
+	var directions []string
+	if info.Input {
+		directions = append(directions, "input")
+	}
+	if info.Output {
+		directions = append(directions, "output")
+	}
+	return fmt.Sprintf("%d) %s %s (%s)", info.ID, info.Name, strings.Join(directions, "/"), info.Interface)
+}
+
+// matchesName returns whether the pattern is part of the name, ignoring
+// case, or whether the pattern is a regular expression matching the name
+func matchesName(pattern, name string) bool {
+	if strings.Contains(strings.ToLower(name), strings.ToLower(pattern)) {
+		return true
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false
+	}
+	return re.MatchString(name)
+}
+
+// virtualPorts are parts of the names of ports that are not instruments,
+// like the Midi Through port of Linux, which are only used by name
+var virtualPorts = []string{"through", "virtual", "virmidi"}
+
+// isVirtual returns whether the port is not an instrument
+func isVirtual(name string) bool {
+	for _, virtual := range virtualPorts {
+		if strings.Contains(strings.ToLower(name), virtual) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectDevice returns the input or output port whose name matches the
+// pattern. Without a pattern the last port found is used, unless it is
+// a virtual port, so that an instrument is waited for instead.
+func selectDevice(devices []DeviceInfo, pattern string, input bool) (device DeviceInfo, err error) {
+	direction := "output"
+	if input {
+		direction = "input"
+	}
+	var names []string
+	found := false
+	for _, info := range devices {
+		if (input && !info.Input) || (!input && !info.Output) {
+			continue
+		}
+		names = append(names, fmt.Sprintf("%q", info.Name))
+		if (pattern == "" && !isVirtual(info.Name)) || (pattern != "" && !found && matchesName(pattern, info.Name)) {
+			device = info
+			found = true
+		}
+	}
+	if len(names) == 0 {
+		err = fmt.Errorf("no MIDI %s devices found", direction)
+	} else if !found && pattern == "" {
+		err = fmt.Errorf("no MIDI %s devices found besides %s", direction, strings.Join(names, ", "))
+	} else if !found {
+		err = fmt.Errorf("no MIDI %s device matches %q, available: %s", direction, pattern, strings.Join(names, ", "))
+	}
+	return
+}
@@ -0,0 +1,148 @@
+package piano
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSelectDevice(t *testing.T) {
+	devices := []DeviceInfo{
+		{ID: 0, Name: "Midi Through Port-0", Input: true, Output: true},
+		{ID: 1, Name: "Digital Piano MIDI 1", Input: true},
+		{ID: 2, Name: "Digital Piano MIDI 1", Output: true},
+		{ID: 3, Name: "USB Synth", Output: true},
+	}
+	tests := []struct {
+		pattern string
+		input   bool
+		id      int
+		err     bool
+	}{
+		// the last port is used by default
+		{"", true, 1, false},
+		{"", false, 3, false},
+		// substrings ignore case
+		{"piano", true, 1, false},
+		{"piano", false, 2, false},
+		{"through", false, 0, false},
+		// regular expressions
+		{"^USB", false, 3, false},
+		{"Port-[0-9]$", true, 0, false},
+		// missing devices
+		{"synth", true, 0, true},
+		{"organ", false, 0, true},
+	}
+	for _, test := range tests {
+		device, err := selectDevice(devices, test.pattern, test.input)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q (input %v): expected an error, got %s", test.pattern, test.input, device)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q (input %v): %s", test.pattern, test.input, err)
+		} else if device.ID != test.id {
+			t.Errorf("%q (input %v): got %s, expected %d", test.pattern, test.input, device, test.id)
+		}
+	}
+
+	if _, err := selectDevice(nil, "", true); err == nil {
+		t.Error("expected an error without devices")
+	}
+	// the through port is only used by name
+	if device, err := selectDevice(devices[:1], "", true); err == nil {
+		t.Errorf("expected an error with only %s", device)
+	}
+}
+
+// listedDevice is a loopback that opens when one of the
+// ports of its backend matches its input
+type listedDevice struct {
+	*Loopback
+	devices func() []DeviceInfo
+	input   string
+}
+
+func (d *listedDevice) Open() (err error) {
+	device, err := selectDevice(d.devices(), d.input, true)
+	if err != nil {
+		return
+	}
+	d.Name = device.Name
+	return d.Loopback.Open()
+}
+
+func TestWatchWaitsForDevice(t *testing.T) {
+	var mutex sync.Mutex
+	devices := []DeviceInfo{
+		{ID: 0, Name: "Midi Through Port-0", Input: true, Output: true},
+		{ID: 1, Name: "USB Synth", Output: true},
+	}
+	list := func() []DeviceInfo {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]DeviceInfo(nil), devices...)
+	}
+	registerBackend(Backend{
+		Name: "test",
+		List: func() ([]DeviceInfo, error) {
+			return list(), nil
+		},
+		Plugged: func() ([]DeviceInfo, error) {
+			return list(), nil
+		},
+		New: func(input, output string) Device {
+			return &listedDevice{Loopback: NewLoopback(), devices: list, input: input}
+		},
+	})
+	defer delete(backends, "test")
+
+	for _, input := range []string{"piano", ""} {
+		// other ports are plugged in, so the watcher waits for the piano
+		w, err := Watch("test", input, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Interval = 5 * time.Millisecond
+		connections := make(chan bool, 10)
+		w.OnConnect = func(connected bool) {
+			connections <- connected
+		}
+		if err = w.Open(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-connections:
+			t.Errorf("%q connected to %s", input, w.InputName())
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		mutex.Lock()
+		devices = append(devices, DeviceInfo{ID: 2, Name: "Digital Piano", Input: true, Output: true})
+		mutex.Unlock()
+		select {
+		case connected := <-connections:
+			if !connected || w.InputName() != "Digital Piano" {
+				t.Errorf("%q connected to %q", input, w.InputName())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%q did not connect", input)
+		}
+
+		// the port goes away, while the device reads nothing
+		mutex.Lock()
+		devices = devices[:2]
+		mutex.Unlock()
+		select {
+		case connected := <-connections:
+			if connected {
+				t.Errorf("%q connected again", input)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%q did not disconnect", input)
+		}
+		w.Close()
+	}
+}
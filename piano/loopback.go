@@ -0,0 +1,148 @@
+package piano
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerBackend(Backend{
+		Name: "loopback",
+		List: func() ([]DeviceInfo, error) {
+			return []DeviceInfo{{Name: "loopback", Interface: "memory", Input: true, Output: true}}, nil
+		},
+		New: func(input, output string) Device {
+			return NewLoopback()
+		},
+	})
+}
+
+// Loopback is an in-memory device, which plays scripted events
+// and records everything written to it. It needs no hardware,
+// so it can be used for testing.
+type Loopback struct {
+	// Name is returned as the name of the input device
+	Name string
+
+	events  chan Event
+	written []Event
+	start   time.Time
+	isOpen  bool
+	// closing stops the senders of Play, which Close waits for
+	// before closing the events
+	closing chan bool
+	sending sync.WaitGroup
+	sync.Mutex
+}
+
+// NewLoopback returns a loopback device
+func NewLoopback() *Loopback {
+	return &Loopback{Name: "loopback"}
+}
+
+// Open readies the device for playing and recording
+func (d *Loopback) Open() (err error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.isOpen {
+		return errors.New("loopback is already open")
+	}
+	d.events = make(chan Event, 1024)
+	d.closing = make(chan bool)
+	d.start = time.Now()
+	d.isOpen = true
+	return
+}
+
+// Play sends events to the listener, as if they were played on the
+// device. Events without a timestamp are stamped with the current time.
+// It waits while the listener is behind, until the device is closed.
+func (d *Loopback) Play(events ...Event) (err error) {
+	d.Lock()
+	if !d.isOpen {
+		d.Unlock()
+		return errors.New("loopback is not open")
+	}
+	ch, closing, start := d.events, d.closing, d.start
+	d.sending.Add(1)
+	d.Unlock()
+	defer d.sending.Done()
+	for _, event := range events {
+		if event.Timestamp == 0 {
+			event.Timestamp = int64(time.Since(start) / time.Millisecond)
+		}
+		select {
+		case ch <- event:
+		case <-closing:
+			return errors.New("loopback is closed")
+		}
+	}
+	return
+}
+
+// Listen returns the events sent with Play
+func (d *Loopback) Listen() <-chan Event {
+	d.Lock()
+	defer d.Unlock()
+	return d.events
+}
+
+// Write records the events
+func (d *Loopback) Write(events []Event) (err error) {
+	d.Lock()
+	defer d.Unlock()
+	if !d.isOpen {
+		return errors.New("loopback is not open")
+	}
+	for _, event := range events {
+		if event.Timestamp == 0 {
+			event.Timestamp = d.now()
+		}
+		d.written = append(d.written, event)
+	}
+	return
+}
+
+// Written returns a copy of the events written to the device
+func (d *Loopback) Written() []Event {
+	d.Lock()
+	defer d.Unlock()
+	written := make([]Event, len(d.written))
+	copy(written, d.written)
+	return written
+}
+
+// InputName returns the name of the device
+func (d *Loopback) InputName() string {
+	return d.Name
+}
+
+// Close stops the listener
+func (d *Loopback) Close() (err error) {
+	d.Lock()
+	if !d.isOpen {
+		d.Unlock()
+		return
+	}
+	d.isOpen = false
+	events := d.events
+	close(d.closing)
+	d.Unlock()
+	d.sending.Wait()
+	close(events)
+	return
+}
+
+// Now returns the time of the device clock, in milliseconds,
+// for scripting events with timestamps
+func (d *Loopback) Now() int64 {
+	d.Lock()
+	defer d.Unlock()
+	return d.now()
+}
+
+// now is the milliseconds since the device was opened
+func (d *Loopback) now() int64 {
+	return int64(time.Since(d.start) / time.Millisecond)
+}
@@ -0,0 +1,46 @@
+package piano
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoopbackCloseWhileFull(t *testing.T) {
+	d := NewLoopback()
+	if err := d.Open(); err != nil {
+		t.Fatal(err)
+	}
+	// nobody listens, so the events fill up the buffer
+	played := make(chan error)
+	go func() {
+		events := make([]Event, 1025)
+		for i := range events {
+			events[i] = Event{Status: 0x90, Data1: 60, Data2: 100}
+		}
+		played <- d.Play(events...)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan error)
+	go func() {
+		closed <- d.Close()
+	}()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close is stuck behind Play")
+	}
+	if err := <-played; err == nil {
+		t.Error("Play of a closed loopback succeeded")
+	}
+	n := 0
+	for range d.Listen() {
+		n++
+	}
+	if n != 1024 {
+		t.Errorf("listened to %d events", n)
+	}
+}
@@ -0,0 +1,154 @@
+package piano
+
+import (
+	"errors"
+	"time"
+
+	"github.com/schollz/pianoai/music"
+	log "github.com/sirupsen/logrus"
+)
+
+// Performer is a device that plays recorded music in real time, as if
+// someone was playing it on the keyboard. The notes written to it are
+// sent to another device, so the AI can still be heard.
+type Performer struct {
+	// Music is played from its first note, at its own tempo
+	Music *music.Music
+	// Speed multiplies the tempo, 2 plays twice as fast
+	Speed float64
+	// Output receives the notes written to the performer,
+	// they are dropped when it is nil
+	Output Device
+
+	// tick is the time between two ticks of the music
+	tick     time.Duration
+	events   chan Event
+	finished chan bool
+	done     chan bool
+	stopped  chan bool
+}
+
+// NewPerformer returns a device that plays the music, and
+// plays the notes written to it on the output device
+func NewPerformer(m *music.Music, output Device) *Performer {
+	return &Performer{
+		Music:  m,
+		Speed:  1,
+		Output: output,
+	}
+}
+
+// Open opens the output and starts playing
+func (d *Performer) Open() (err error) {
+	d.Music.RLock()
+	bpm, ticksPerBeat := d.Music.BPM, d.Music.TicksPerBeat
+	d.Music.RUnlock()
+	if bpm <= 0 || ticksPerBeat <= 0 {
+		return errors.New("music to perform has no tempo")
+	}
+	if d.Speed <= 0 {
+		return errors.New("speed of the performer must be positive")
+	}
+	d.tick = time.Duration(float64(time.Minute) / float64(bpm*ticksPerBeat) / d.Speed)
+	if d.Output != nil {
+		err = d.Output.Open()
+		if err != nil {
+			return
+		}
+	}
+	d.events = make(chan Event, 1024)
+	d.finished = make(chan bool)
+	d.done = make(chan bool)
+	d.stopped = make(chan bool)
+	go d.play()
+	if d.Output != nil {
+		go drain(d.Output.Listen(), d.done)
+	}
+	return
+}
+
+// drain reads the events of the output, like active sensing or the
+// keys of its keyboard, so that the output does not stop reading
+// when nobody listens to it
+func drain(events <-chan Event, done chan bool) {
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// play sends the notes when it is their time, and waits for
+// the device to close
+func (d *Performer) play() {
+	logger := log.WithFields(log.Fields{
+		"function": "Performer.play",
+	})
+	defer close(d.stopped)
+	defer close(d.events)
+
+	notes := d.Music.GetAll()
+	logger.Infof("Performing %d notes", len(notes))
+	start := time.Now()
+	for _, note := range notes {
+		at := time.Duration(note.Beat-notes[0].Beat) * d.tick
+		select {
+		case <-d.done:
+			return
+		case <-time.After(at - time.Since(start)):
+		}
+		event := Event{Timestamp: int64(time.Since(start) / time.Millisecond)}
+		event.Status, event.Data1, event.Data2 = note.MIDI()
+		select {
+		case <-d.done:
+			return
+		case d.events <- event:
+		}
+	}
+	logger.Info("Finished performing")
+	close(d.finished)
+	<-d.done
+}
+
+// Listen returns the notes of the music as they are played
+func (d *Performer) Listen() <-chan Event {
+	return d.events
+}
+
+// Finished is closed when all the music has been played
+func (d *Performer) Finished() <-chan bool {
+	return d.finished
+}
+
+// Write plays the events on the output
+func (d *Performer) Write(events []Event) (err error) {
+	if d.Output == nil {
+		return
+	}
+	return d.Output.Write(events)
+}
+
+// InputName returns the name of the device the music was recorded on
+func (d *Performer) InputName() string {
+	d.Music.RLock()
+	defer d.Music.RUnlock()
+	return d.Music.Device
+}
+
+// Close stops playing and closes the output
+func (d *Performer) Close() (err error) {
+	if d.done != nil {
+		close(d.done)
+		<-d.stopped
+		d.done = nil
+	}
+	if d.Output != nil {
+		err = d.Output.Close()
+	}
+	return
+}
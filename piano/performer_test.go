@@ -0,0 +1,94 @@
+package piano
+
+import (
+	"testing"
+	"time"
+
+	"github.com/schollz/pianoai/music"
+)
+
+func TestPerformer(t *testing.T) {
+	m := music.New()
+	m.BPM = 120
+	m.TicksPerBeat = 100
+	m.AddNote(music.Note{On: true, Pitch: 60, Velocity: 100, Beat: 1000})
+	m.AddNote(music.Note{On: false, Pitch: 60, Velocity: 0, Beat: 1050})
+	m.AddNote(music.Note{On: true, Pitch: 64, Velocity: 80, Beat: 1200})
+	m.AddNote(music.Note{On: false, Pitch: 64, Velocity: 0, Beat: 1300})
+
+	output := NewLoopback()
+	d := NewPerformer(m, output)
+	// 300 ticks at 120 bpm are 1.5 s, played in 150 ms
+	d.Speed = 10
+	if err := d.Open(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	var events []Event
+	for len(events) < 4 {
+		select {
+		case event := <-d.Listen():
+			events = append(events, event)
+		case <-time.After(time.Second):
+			t.Fatalf("only %d events were played", len(events))
+		}
+	}
+	<-d.Finished()
+	if elapsed := time.Since(start); elapsed < 140*time.Millisecond || elapsed > time.Second {
+		t.Errorf("played in %s, expected 150ms", elapsed)
+	}
+	expected := []Event{
+		{Status: 0x90, Data1: 60, Data2: 100},
+		{Status: 0x80, Data1: 60, Data2: 0},
+		{Status: 0x90, Data1: 64, Data2: 80},
+		{Status: 0x80, Data1: 64, Data2: 0},
+	}
+	for i := range expected {
+		if events[i].Status != expected[i].Status || events[i].Data1 != expected[i].Data1 || events[i].Data2 != expected[i].Data2 {
+			t.Errorf("event %d is %+v, expected %+v", i, events[i], expected[i])
+		}
+		if i > 0 && events[i].Timestamp < events[i-1].Timestamp {
+			t.Errorf("event %d is played before the previous one", i)
+		}
+	}
+
+	// notes written to the performer are played on the output
+	d.Write([]Event{{Status: 0x90, Data1: 72, Data2: 90}})
+	if written := output.Written(); len(written) != 1 || written[0].Data1 != 72 {
+		t.Errorf("output got %+v", written)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-d.Listen(); ok {
+		t.Error("events are still open after closing")
+	}
+}
+
+func TestPerformerDrainsOutput(t *testing.T) {
+	m := music.New()
+	m.BPM = 120
+	m.TicksPerBeat = 100
+	m.AddNote(music.Note{On: true, Pitch: 60, Velocity: 100, Beat: 0})
+
+	output := NewLoopback()
+	d := NewPerformer(m, output)
+	if err := d.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	// the output keeps sending active sensing, which nobody plays
+	played := make(chan bool)
+	go func() {
+		for i := 0; i < 2000; i++ {
+			output.Play(Event{Status: 0xFE})
+		}
+		close(played)
+	}()
+	select {
+	case <-played:
+	case <-time.After(time.Second):
+		t.Fatal("events of the output were not read")
+	}
+}
@@ -1,9 +1,11 @@
 package piano
 
 import (
+	"fmt"
+	"sort"
 	"sync"
+	"time"
 
-	"github.com/rakyll/portmidi"
 	"github.com/schollz/pianoai/music"
 	log "github.com/sirupsen/logrus"
 )
@@ -20,128 +22,320 @@ func init() {
 	log.SetLevel(log.DebugLevel)
 }
 
+// Event is a MIDI message read from or written to a device
+type Event struct {
+	// Timestamp is when the event happened, in milliseconds
+	// of the clock of the device
+	Timestamp int64
+	Status    int
+	Data1     int
+	Data2     int
+}
+
+// Device is a connection to a MIDI keyboard
+type Device interface {
+	// Open connects to the device
+	Open() error
+	// Listen returns the events played on the device. The
+	// channel is closed when the device is closed.
+	Listen() <-chan Event
+	// Write sends the events to the device
+	Write(events []Event) error
+	// Close disconnects the device
+	Close() error
+}
+
+// deviceClock is a device with a clock, which plays the events that
+// are written at their timestamps, like portmidi. Now returns the
+// time of the clock in milliseconds, or 0 when it is not running.
+type deviceClock interface {
+	Now() int64
+}
+
 // Piano is the AI class for the piano
 type Piano struct {
-	InputDevice  portmidi.DeviceID
-	OutputDevice portmidi.DeviceID
-	outputStream *portmidi.Stream
-	InputStream  *portmidi.Stream
+	// Device is the MIDI connection to the keyboard
+	Device Device
+	// sounding counts the notes that are on, by channel and pitch
+	sounding map[[2]int]int
+	// pedals are the pedals that are down, by channel and controller
+	pedals map[[2]int]bool
+	// lastTimestamp is the timestamp of the last write
+	lastTimestamp int64
 	sync.Mutex
 }
 
-// New sets the device ports. Optionally you can
-// pass the input and output ports, respectively.
-func New(ports ...int) (p *Piano, err error) {
+// New connects to the keyboard with the default backend, using the
+// input and output ports that match the names (see PortMIDI)
+func New(input, output string) (p *Piano, err error) {
+	device, err := NewDevice("", input, output)
+	if err != nil {
+		return
+	}
+	return NewWithDevice(device)
+}
+
+// NewWithDevice opens the device and uses it as the keyboard
+func NewWithDevice(device Device) (p *Piano, err error) {
 	p = new(Piano)
+	p.Device = device
+	p.sounding = make(map[[2]int]int)
+	err = p.Device.Open()
+	return
+}
+
+// Listen returns the events played on the keyboard
+func (p *Piano) Listen() <-chan Event {
+	return p.Device.Listen()
+}
+
+// InputName returns the name of the input device, if it has one
+func (p *Piano) InputName() string {
+	return inputName(p.Device)
+}
+
+// inputName returns the name of the input of devices that have one
+func inputName(device Device) string {
+	if named, ok := device.(interface {
+		InputName() string
+	}); ok {
+		return named.InputName()
+	}
+	return ""
+}
+
+// Close will turn off the notes, shutdown the device
+// and gracefully terminate.
+func (p *Piano) Close() (err error) {
 	logger := log.WithFields(log.Fields{
-		"function": "Piano.Init",
+		"function": "Piano.Close",
 	})
-	logger.Debug("Initializing portmidi...")
-	err = portmidi.Initialize()
+	err = p.Release()
 	if err != nil {
-		logger.WithFields(log.Fields{
-			"msg": "initiailization failed",
-		}).Error(err.Error())
-		return
+		logger.Warn(err.Error())
 	}
-	numDevices := portmidi.CountDevices()
-	logger.Debugf("Found %d devices", numDevices)
-	for i := 0; i < numDevices; i++ {
-		deviceInfo := portmidi.Info(portmidi.DeviceID(i))
-		var inputOutput string
-		if deviceInfo.IsOutputAvailable {
-			inputOutput = "output"
-			p.OutputDevice = portmidi.DeviceID(i)
-		} else {
-			inputOutput = "input"
-			p.InputDevice = portmidi.DeviceID(i)
+	logger.Debug("Closing device")
+	return p.Device.Close()
+}
+
+// Sounding returns the notes that are on, ordered by channel and pitch
+func (p *Piano) Sounding() (notes []music.Note) {
+	p.Lock()
+	defer p.Unlock()
+	for _, key := range p.soundingKeys() {
+		for i := 0; i < p.sounding[key]; i++ {
+			notes = append(notes, music.Note{On: true, Pitch: key[1], Channel: key[0]})
 		}
-		logger.Debugf("%d) %s %s %s", i, deviceInfo.Interface, deviceInfo.Name, inputOutput)
 	}
-	if len(ports) == 2 {
-		p.InputDevice = portmidi.DeviceID(ports[0])
-		p.OutputDevice = portmidi.DeviceID(ports[1])
+	return
+}
+
+// soundingKeys returns the channels and pitches of the notes that
+// are on, in order. The lock must be held.
+func (p *Piano) soundingKeys() (keys [][2]int) {
+	for key := range p.sounding {
+		keys = append(keys, key)
 	}
-	logger.Infof("Using input device %d and output device %d", p.InputDevice, p.OutputDevice)
+	sortKeys(keys)
+	return
+}
 
-	logger.Debug("Opening output stream")
-	p.outputStream, err = portmidi.NewOutputStream(p.OutputDevice, 1024, 0)
-	if err != nil {
-		if err != nil {
-			logger.WithFields(log.Fields{
-				"msg": "problem getting output stream from device " + string(p.OutputDevice),
-			}).Error(err.Error())
-			return
+// sortKeys sorts the channels and pitches, or controllers
+func sortKeys(keys [][2]int) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
 		}
+		return keys[i][1] < keys[j][1]
+	})
+}
 
+// release returns the note offs of the notes that are on, and then
+// lifts the pedals that are down, and forgets them. The lock must
+// be held.
+func (p *Piano) release() (events []Event) {
+	for _, key := range p.soundingKeys() {
+		for i := 0; i < p.sounding[key]; i++ {
+			events = append(events, Event{Status: 0x80 | key[0], Data1: key[1]})
+		}
 	}
+	p.sounding = make(map[[2]int]int)
+	var pedals [][2]int
+	for key := range p.pedals {
+		pedals = append(pedals, key)
+	}
+	sortKeys(pedals)
+	for _, key := range pedals {
+		events = append(events, Event{Status: 0xB0 | key[0], Data1: key[1], Data2: 0})
+	}
+	p.pedals = make(map[[2]int]bool)
+	return
+}
 
-	logger.Debug("Opening input stream")
-	p.InputStream, err = portmidi.NewInputStream(p.InputDevice, 1024)
-	if err != nil {
-		if err != nil {
-			logger.WithFields(log.Fields{
-				"msg": "problem getting input stream from device " + string(p.InputDevice),
-			}).Error(err.Error())
-			return
-		}
+// Release turns off every note that is on, and lifts the pedals
+func (p *Piano) Release() (err error) {
+	p.Lock()
+	defer p.Unlock()
+	events := p.release()
+	if len(events) == 0 {
+		return
+	}
+	log.WithFields(log.Fields{
+		"function": "Piano.Release",
+	}).Debugf("Releasing %d notes and pedals", len(events))
+	return p.write(events, time.Time{})
+}
 
+// Panic turns off every note that is on, and then lifts the sustain
+// pedal and sends all notes off on every channel, in case notes
+// were turned on by someone else
+func (p *Piano) Panic() (err error) {
+	p.Lock()
+	defer p.Unlock()
+	log.WithFields(log.Fields{
+		"function": "Piano.Panic",
+	}).Info("Turning off all notes")
+	events := p.release()
+	for channel := 0; channel < 16; channel++ {
+		events = append(events,
+			Event{Status: 0xB0 | channel, Data1: music.SustainPedal, Data2: 0},
+			Event{Status: 0xB0 | channel, Data1: 123, Data2: 0},
+		)
 	}
-	return
+	return p.write(events, time.Time{})
 }
 
-// Close will shutdown the streams
-// and gracefully terminate.
-func (p *Piano) Close() (err error) {
+// track counts the notes that are turned on and off, and keeps the
+// pedals that are down. The lock must be held.
+func (p *Piano) track(note music.Note) {
+	if note.IsPedal() {
+		if p.pedals == nil {
+			p.pedals = make(map[[2]int]bool)
+		}
+		key := [2]int{note.Channel & 0x0F, note.Pitch}
+		if note.IsRelease() {
+			delete(p.pedals, key)
+		} else {
+			p.pedals[key] = true
+		}
+		return
+	}
+	if !note.IsNote() {
+		return
+	}
+	if p.sounding == nil {
+		p.sounding = make(map[[2]int]int)
+	}
+	key := [2]int{note.Channel & 0x0F, note.Pitch}
+	if note.On && note.Velocity > 0 {
+		p.sounding[key]++
+	} else if p.sounding[key] > 1 {
+		p.sounding[key]--
+	} else {
+		delete(p.sounding, key)
+	}
+}
+
+// WriteEvents sends MIDI messages to the keyboard
+func (p *Piano) WriteEvents(events ...Event) (err error) {
+	return p.WriteEventsAt(time.Time{}, events...)
+}
+
+// WriteEventsAt writes the events at the time at, like PlayNotesAt
+func (p *Piano) WriteEventsAt(at time.Time, events ...Event) (err error) {
+	p.Lock()
+	defer p.Unlock()
+	return p.write(events, at)
+}
+
+// SetupVoices selects the instruments of the voices
+func (p *Piano) SetupVoices(voices ...Voice) (err error) {
+	p.Lock()
+	defer p.Unlock()
 	logger := log.WithFields(log.Fields{
-		"function": "Piano.Close",
+		"function": "Piano.SetupVoices",
 	})
-	logger.Debug("Closing output stream")
-	p.outputStream.Close()
-	logger.Debug("Closing input stream")
-	p.InputStream.Close()
-	logger.Debug("Terminating portmidi")
-	portmidi.Terminate()
-	return
+	var events []Event
+	for _, voice := range voices {
+		if voice.Program > 0 {
+			logger.Debugf("Channel %d plays program %d of bank %d", voice.Channel+1, voice.Program, voice.Bank)
+		}
+		events = append(events, voice.Setup()...)
+	}
+	if len(events) == 0 {
+		return
+	}
+	return p.write(events, time.Time{})
 }
 
-// PlayNotes will play all the notes
+// write stamps the events with the time at, or with the current time
+// when at is zero, and writes them to the device. Only devices with a
+// clock are stamped, and the timestamps never go back, so that the
+// events stay in the order they are written. The lock must be held.
+func (p *Piano) write(events []Event, at time.Time) (err error) {
+	clock, ok := p.Device.(deviceClock)
+	if !ok {
+		return p.Device.Write(events)
+	}
+	now := clock.Now()
+	timestamp := now
+	if !at.IsZero() {
+		timestamp -= int64(time.Since(at) / time.Millisecond)
+	}
+	// a clock that is behind the last write was started again
+	if timestamp < p.lastTimestamp && p.lastTimestamp <= now {
+		timestamp = p.lastTimestamp
+	}
+	if timestamp > 0 {
+		p.lastTimestamp = timestamp
+		for i := range events {
+			if events[i].Timestamp == 0 {
+				events[i].Timestamp = timestamp
+			}
+		}
+	}
+	return p.Device.Write(events)
+}
+
+// PlayNotes will play all the notes right away, including
+// control changes and pitch bends
 func (p *Piano) PlayNotes(notes []music.Note, bpm int) (err error) {
+	return p.PlayNotesAt(notes, bpm, time.Time{})
+}
+
+// PlayNotesAt plays the notes at the time at, which is usually a
+// little in the past. Devices with a clock play them that long after
+// the events are written, see PortMIDI.Latency, so the time it takes
+// to write them does not change when they sound.
+func (p *Piano) PlayNotesAt(notes []music.Note, bpm int, at time.Time) (err error) {
 	p.Lock()
 	defer p.Unlock()
 	logger := log.WithFields(log.Fields{
 		"function": "Piano.PlayNotes",
 	})
-	for _, note := range notes {
-		if note.On {
-			logger.WithFields(log.Fields{
-				"p": note.Pitch,
-				"v": note.Velocity,
-			}).Debugf("on, beat %d", note.Beat)
-			err = p.outputStream.WriteShort(0x90, int64(note.Pitch), int64(note.Velocity))
-			if err != nil {
-				logger.WithFields(log.Fields{
-					"p":   note.Pitch,
-					"v":   note.Velocity,
-					"msg": "problem turning on",
-				}).Error(err.Error())
-				return
-			}
-		} else {
-			logger.WithFields(log.Fields{
-				"p": note.Pitch,
-				"v": note.Velocity,
-			}).Debugf("off, beat %d", note.Beat)
-			err = p.outputStream.WriteShort(0x80, int64(note.Pitch), int64(note.Velocity))
-			if err != nil {
-				logger.WithFields(log.Fields{
-					"p":   note.Pitch,
-					"v":   note.Velocity,
-					"msg": "problem turning off",
-				}).Error(err.Error())
-				return
-			}
+	events := make([]Event, len(notes))
+	for i, note := range notes {
+		kind := "off"
+		switch {
+		case note.Kind == music.ControlEvent:
+			kind = fmt.Sprintf("control %d", note.Pitch)
+		case note.Kind == music.PitchBendEvent:
+			kind = "pitch bend"
+		case note.On:
+			kind = "on"
 		}
+		logger.WithFields(log.Fields{
+			"p": note.Pitch,
+			"v": note.Velocity,
+		}).Debugf("%s, beat %d", kind, note.Beat)
+		events[i].Status, events[i].Data1, events[i].Data2 = note.MIDI()
+		p.track(note)
+	}
+	err = p.write(events, at)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"msg": "problem writing notes",
+		}).Error(err.Error())
 	}
 	return
 }
@@ -0,0 +1,109 @@
+package piano
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/schollz/pianoai/music"
+)
+
+func TestSoundingNotes(t *testing.T) {
+	device := NewLoopback()
+	p, err := NewWithDevice(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.PlayNotes([]music.Note{
+		{On: true, Pitch: 60, Velocity: 100},
+		{On: true, Pitch: 64, Velocity: 100, Channel: 1},
+		{On: true, Pitch: 67, Velocity: 100},
+		{Kind: music.ControlEvent, Pitch: music.SustainPedal, Velocity: 127},
+	}, 120)
+	p.PlayNotes([]music.Note{
+		{On: false, Pitch: 67},
+		// a note on without velocity is a note off
+		{On: true, Pitch: 60, Velocity: 0},
+		// releasing a note that is not on does nothing
+		{On: false, Pitch: 50},
+	}, 120)
+	expected := []music.Note{{On: true, Pitch: 64, Channel: 1}}
+	if sounding := p.Sounding(); !reflect.DeepEqual(sounding, expected) {
+		t.Errorf("sounding %+v, expected %+v", sounding, expected)
+	}
+
+	// closing turns off the notes that are still on
+	p.PlayNotes([]music.Note{{On: true, Pitch: 72, Velocity: 100}}, 120)
+	before := len(device.Written())
+	if err = p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var offs [][2]int
+	for _, event := range device.Written()[before:] {
+		offs = append(offs, [2]int{event.Status, event.Data1})
+	}
+	// and lifts the sustain pedal that is still down
+	if expected := [][2]int{{0x80, 72}, {0x81, 64}, {0xB0, music.SustainPedal}}; !reflect.DeepEqual(offs, expected) {
+		t.Errorf("closing sent %v, expected %v", offs, expected)
+	}
+	if sounding := p.Sounding(); len(sounding) != 0 {
+		t.Errorf("%+v are still sounding", sounding)
+	}
+}
+
+func TestPanic(t *testing.T) {
+	device := NewLoopback()
+	p, err := NewWithDevice(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.PlayNotes([]music.Note{{On: true, Pitch: 60, Velocity: 100, Channel: 2}}, 120)
+	before := len(device.Written())
+	if err = p.Panic(); err != nil {
+		t.Fatal(err)
+	}
+	events := device.Written()[before:]
+	if len(events) != 1+2*16 {
+		t.Fatalf("panic sent %d events", len(events))
+	}
+	if events[0].Status != 0x82 || events[0].Data1 != 60 {
+		t.Errorf("first event %+v should turn off the note", events[0])
+	}
+	allNotesOff := 0
+	for _, event := range events[1:] {
+		if event.Status&0xF0 == 0xB0 && event.Data1 == 123 {
+			allNotesOff++
+		}
+	}
+	if allNotesOff != 16 {
+		t.Errorf("sent all notes off on %d channels", allNotesOff)
+	}
+	if sounding := p.Sounding(); len(sounding) != 0 {
+		t.Errorf("%+v are still sounding", sounding)
+	}
+}
+
+func TestPlayNotesAt(t *testing.T) {
+	device := NewLoopback()
+	p, err := NewWithDevice(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// the notes of a tick that was reached a while ago
+	p.PlayNotesAt([]music.Note{{On: true, Pitch: 60, Velocity: 100}}, 120, time.Now().Add(-50*time.Millisecond))
+	now := device.Now()
+	written := device.Written()
+	if stamp := written[len(written)-1].Timestamp; stamp < now-60 || stamp > now-40 {
+		t.Errorf("note is stamped %d, expected %d", stamp, now-50)
+	}
+	// and the timestamps never go back
+	p.PlayNotesAt([]music.Note{{On: false, Pitch: 60}}, 120, time.Now().Add(-80*time.Millisecond))
+	written = device.Written()
+	if written[1].Timestamp < written[0].Timestamp {
+		t.Errorf("timestamps went back: %+v", written)
+	}
+}
@@ -0,0 +1,240 @@
+//go:build cgo
+// +build cgo
+
+package piano
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rakyll/portmidi"
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	registerBackend(Backend{
+		Name: "portmidi",
+		List: ListPortMIDI,
+		// portmidi does not see ports that are unplugged until
+		// it starts again, the sequencer of Linux does
+		Plugged: ListSequencer,
+		New: func(input, output string) Device {
+			return NewPortMIDI(input, output)
+		},
+	})
+}
+
+// PortMIDILatency is the default Latency of PortMIDI devices
+const PortMIDILatency = 10
+
+// PortMIDI is a device connected through libportmidi
+type PortMIDI struct {
+	// Input and Output select the ports by name, either with a part of
+	// the name or with a regular expression. The last ports found are
+	// used when they are empty.
+	Input  string
+	Output string
+	// Latency is the delay of the output in milliseconds. Events
+	// are played that long after their timestamp, so they sound
+	// on time when they are written a little late.
+	Latency      int64
+	InputDevice  portmidi.DeviceID
+	OutputDevice portmidi.DeviceID
+	outputStream *portmidi.Stream
+	inputStream  *portmidi.Stream
+	events       chan Event
+	done         chan bool
+	stopped      chan bool
+}
+
+// NewPortMIDI returns a portmidi device, with the input and
+// output ports that match the names (see PortMIDI)
+func NewPortMIDI(input, output string) *PortMIDI {
+	return &PortMIDI{Input: input, Output: output, Latency: PortMIDILatency}
+}
+
+// ListPortMIDI returns the ports that portmidi can use
+func ListPortMIDI() (devices []DeviceInfo, err error) {
+	err = portmidi.Initialize()
+	if err != nil {
+		return
+	}
+	devices = portMIDIDevices()
+	err = portmidi.Terminate()
+	return
+}
+
+// portMIDIDevices returns the ports of an initialized portmidi
+func portMIDIDevices() (devices []DeviceInfo) {
+	numDevices := portmidi.CountDevices()
+	for i := 0; i < numDevices; i++ {
+		info := portmidi.Info(portmidi.DeviceID(i))
+		if info == nil {
+			continue
+		}
+		devices = append(devices, DeviceInfo{
+			ID:        i,
+			Name:      info.Name,
+			Interface: info.Interface,
+			Input:     info.IsInputAvailable,
+			Output:    info.IsOutputAvailable,
+		})
+	}
+	return
+}
+
+// Open finds the device ports and opens the streams
+func (d *PortMIDI) Open() (err error) {
+	logger := log.WithFields(log.Fields{
+		"function": "PortMIDI.Open",
+	})
+	logger.Debug("Initializing portmidi...")
+	err = portmidi.Initialize()
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"msg": "initiailization failed",
+		}).Error(err.Error())
+		return
+	}
+	devices := portMIDIDevices()
+	logger.Debugf("Found %d devices", len(devices))
+	for _, info := range devices {
+		logger.Debug(info.String())
+	}
+	input, err := selectDevice(devices, d.Input, true)
+	if err != nil {
+		portmidi.Terminate()
+		return
+	}
+	output, err := selectDevice(devices, d.Output, false)
+	if err != nil {
+		portmidi.Terminate()
+		return
+	}
+	d.InputDevice = portmidi.DeviceID(input.ID)
+	d.OutputDevice = portmidi.DeviceID(output.ID)
+	logger.Infof("Using input %s and output %s", input, output)
+
+	logger.Debug("Opening output stream")
+	d.outputStream, err = portmidi.NewOutputStream(d.OutputDevice, 1024, d.Latency)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"msg": fmt.Sprintf("problem getting output stream from device %d", d.OutputDevice),
+		}).Error(err.Error())
+		return
+	}
+
+	logger.Debug("Opening input stream")
+	d.inputStream, err = portmidi.NewInputStream(d.InputDevice, 1024)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"msg": fmt.Sprintf("problem getting input stream from device %d", d.InputDevice),
+		}).Error(err.Error())
+		return
+	}
+
+	d.events = make(chan Event, 1024)
+	d.done = make(chan bool)
+	d.stopped = make(chan bool)
+	go d.read()
+	return
+}
+
+// read polls the input stream until the device is closed,
+// or until reading fails
+func (d *PortMIDI) read() {
+	defer close(d.stopped)
+	defer close(d.events)
+	for {
+		select {
+		case <-d.done:
+			return
+		// sleep for a while before polling again,
+		// otherwise it is too intensive
+		case <-time.After(10 * time.Millisecond):
+		}
+		events, err := d.inputStream.Read(1024)
+		if err != nil {
+			// the device was most likely unplugged
+			log.WithFields(log.Fields{
+				"function": "PortMIDI.read",
+			}).Error(err.Error())
+			return
+		}
+		for _, event := range events {
+			select {
+			case d.events <- Event{
+				Timestamp: int64(event.Timestamp),
+				Status:    int(event.Status),
+				Data1:     int(event.Data1),
+				Data2:     int(event.Data2),
+			}:
+			case <-d.done:
+				return
+			}
+		}
+	}
+}
+
+// Listen returns the events of the input stream
+func (d *PortMIDI) Listen() <-chan Event {
+	return d.events
+}
+
+// Write sends the events to the output stream
+func (d *PortMIDI) Write(events []Event) (err error) {
+	if len(events) == 0 {
+		return
+	}
+	now := portmidi.Time()
+	pmEvents := make([]portmidi.Event, len(events))
+	for i, event := range events {
+		pmEvents[i] = portmidi.Event{
+			Timestamp: portmidi.Timestamp(event.Timestamp),
+			Status:    int64(event.Status),
+			Data1:     int64(event.Data1),
+			Data2:     int64(event.Data2),
+		}
+		if event.Timestamp == 0 {
+			pmEvents[i].Timestamp = now
+		}
+	}
+	return d.outputStream.Write(pmEvents)
+}
+
+// Now returns the time of the portmidi clock, which the
+// timestamps of the events use
+func (d *PortMIDI) Now() int64 {
+	return int64(portmidi.Time())
+}
+
+// InputName returns the name of the input device
+func (d *PortMIDI) InputName() string {
+	info := portmidi.Info(d.InputDevice)
+	if info == nil {
+		return ""
+	}
+	return info.Name
+}
+
+// Close will shutdown the streams and terminate portmidi
+func (d *PortMIDI) Close() (err error) {
+	logger := log.WithFields(log.Fields{
+		"function": "PortMIDI.Close",
+	})
+	if d.done != nil {
+		close(d.done)
+		<-d.stopped
+		d.done = nil
+	}
+	logger.Debug("Closing output stream")
+	if d.outputStream != nil {
+		d.outputStream.Close()
+	}
+	logger.Debug("Closing input stream")
+	if d.inputStream != nil {
+		d.inputStream.Close()
+	}
+	logger.Debug("Terminating portmidi")
+	return portmidi.Terminate()
+}
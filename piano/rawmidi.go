@@ -0,0 +1,85 @@
+package piano
+
+// dataLength is the number of data bytes that follow a status byte
+func dataLength(status int) int {
+	switch status & 0xF0 {
+	case 0xC0, 0xD0:
+		return 1
+	case 0xF0:
+		switch status {
+		case 0xF1, 0xF3:
+			return 1
+		case 0xF2:
+			return 2
+		}
+		return 0
+	}
+	return 2
+}
+
+// midiParser turns a stream of raw MIDI bytes, as read from a
+// serial or USB port, into events. It understands running status,
+// and skips system exclusive messages.
+type midiParser struct {
+	status int
+	data   []int
+	sysex  bool
+}
+
+// parse adds a byte to the message, and returns the event
+// when the message is complete
+func (parser *midiParser) parse(b byte) (event Event, ok bool) {
+	switch {
+	case b >= 0xF8:
+		// real time messages can come between any other bytes
+		return Event{Status: int(b)}, true
+	case b == 0xF0:
+		parser.sysex = true
+		parser.status = 0
+		return
+	case b == 0xF7:
+		parser.sysex = false
+		return
+	case b >= 0x80:
+		parser.sysex = false
+		parser.status = int(b)
+		parser.data = parser.data[:0]
+		if dataLength(parser.status) == 0 {
+			parser.status = 0
+			return Event{Status: int(b)}, true
+		}
+		return
+	}
+	if parser.sysex || parser.status == 0 {
+		return
+	}
+	parser.data = append(parser.data, int(b))
+	if len(parser.data) < dataLength(parser.status) {
+		return
+	}
+	event = Event{Status: parser.status, Data1: parser.data[0]}
+	if len(parser.data) > 1 {
+		event.Data2 = parser.data[1]
+	}
+	parser.data = parser.data[:0]
+	// only channel messages keep a running status
+	if parser.status >= 0xF0 {
+		parser.status = 0
+	}
+	return event, true
+}
+
+// midiBytes returns the raw MIDI bytes of the events
+func midiBytes(events []Event) (data []byte) {
+	for _, event := range events {
+		data = append(data, byte(event.Status))
+		length := dataLength(event.Status)
+		if length > 0 {
+			data = append(data, byte(event.Data1&0x7F))
+		}
+		if length > 1 {
+			data = append(data, byte(event.Data2&0x7F))
+		}
+	}
+	return
+}
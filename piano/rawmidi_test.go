@@ -0,0 +1,54 @@
+package piano
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMIDIParser(t *testing.T) {
+	data := []byte{
+		// note on, with running status for a second note
+		0x90, 60, 100, 64, 90,
+		// a clock in the middle of a note off
+		0x80, 60, 0xF8, 0,
+		// system exclusive is skipped
+		0xF0, 0x7E, 0x7F, 0x09, 0x01, 0xF7,
+		// data without a status is ignored
+		12,
+		// program change and sustain pedal
+		0xC0, 5, 0xB0, 64, 127,
+		// song position clears the running status
+		0xF2, 0x10, 0x20, 1, 2,
+	}
+	expected := []Event{
+		{Status: 0x90, Data1: 60, Data2: 100},
+		{Status: 0x90, Data1: 64, Data2: 90},
+		{Status: 0xF8},
+		{Status: 0x80, Data1: 60, Data2: 0},
+		{Status: 0xC0, Data1: 5},
+		{Status: 0xB0, Data1: 64, Data2: 127},
+		{Status: 0xF2, Data1: 0x10, Data2: 0x20},
+	}
+	var parser midiParser
+	events := []Event{}
+	for _, b := range data {
+		if event, ok := parser.parse(b); ok {
+			events = append(events, event)
+		}
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("got %+v, expected %+v", events, expected)
+	}
+
+	// writing and parsing again gives the same events
+	parser = midiParser{}
+	parsed := []Event{}
+	for _, b := range midiBytes(expected) {
+		if event, ok := parser.parse(b); ok {
+			parsed = append(parsed, event)
+		}
+	}
+	if !reflect.DeepEqual(parsed, expected) {
+		t.Errorf("got %+v, expected %+v", parsed, expected)
+	}
+}
@@ -0,0 +1,46 @@
+package piano
+
+import (
+	"io/ioutil"
+	"strings"
+)
+
+// sequencerClients lists the clients of the ALSA sequencer and their
+// ports, which are the ports that portmidi uses on Linux
+const sequencerClients = "/proc/asound/seq/clients"
+
+// ListSequencer returns the ports of the ALSA sequencer, with the names
+// that portmidi gives them. Unlike portmidi, which only looks for ports
+// when it starts, it sees the ports that are plugged in right now.
+func ListSequencer() (devices []DeviceInfo, err error) {
+	clients, err := ioutil.ReadFile(sequencerClients)
+	if err != nil {
+		return
+	}
+	return sequencerPorts(string(clients)), nil
+}
+
+// sequencerPorts parses the ports of the clients of the sequencer, which
+// have a name and the letters of what they can do, like
+//
+//	Port   0 : "Midi Through Port-0" (RWe-)
+//
+// where R and W (or r and w) tell that it can be read and written.
+func sequencerPorts(clients string) (devices []DeviceInfo) {
+	for _, line := range strings.Split(clients, "\n") {
+		line = strings.TrimSpace(line)
+		start, end := strings.Index(line, `"`), strings.LastIndex(line, `"`)
+		if !strings.HasPrefix(line, "Port") || start < 0 || end <= start {
+			continue
+		}
+		capabilities := strings.Trim(strings.TrimSpace(line[end+1:]), "()") + "--"
+		devices = append(devices, DeviceInfo{
+			ID:        len(devices),
+			Name:      line[start+1 : end],
+			Interface: "ALSA",
+			Input:     strings.ToUpper(capabilities[:1]) == "R",
+			Output:    strings.ToUpper(capabilities[1:2]) == "W",
+		})
+	}
+	return
+}
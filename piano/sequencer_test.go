@@ -0,0 +1,35 @@
+package piano
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSequencerPorts(t *testing.T) {
+	clients := `Client info
+  cur  clients : 3
+  peak clients : 3
+  max  clients : 192
+
+Client   0 : "System" [Kernel]
+  Port   0 : "Timer" (Rwe-)
+  Port   1 : "Announce" (R-e-)
+Client  14 : "Midi Through" [Kernel]
+  Port   0 : "Midi Through Port-0" (RWe-)
+    Connected From: 129:0
+Client  20 : "Digital Piano" [Kernel]
+  Port   0 : "Digital Piano MIDI 1" (RWeX)
+Client 128 : "Synth" [User]
+  Port   0 : "Synth input" (-We-)
+`
+	expected := []DeviceInfo{
+		{ID: 0, Name: "Timer", Interface: "ALSA", Input: true, Output: true},
+		{ID: 1, Name: "Announce", Interface: "ALSA", Input: true, Output: false},
+		{ID: 2, Name: "Midi Through Port-0", Interface: "ALSA", Input: true, Output: true},
+		{ID: 3, Name: "Digital Piano MIDI 1", Interface: "ALSA", Input: true, Output: true},
+		{ID: 4, Name: "Synth input", Interface: "ALSA", Input: false, Output: true},
+	}
+	if devices := sequencerPorts(clients); !reflect.DeepEqual(devices, expected) {
+		t.Errorf("got %+v", devices)
+	}
+}
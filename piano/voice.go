@@ -0,0 +1,62 @@
+package piano
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Voice is an instrument of a multitimbral sound module
+type Voice struct {
+	// Channel is the MIDI channel, from 0 to 15
+	Channel int
+	// Program is the instrument, from 1 to 128, or 0 to keep
+	// the instrument that is already selected on the channel
+	Program int
+	// Bank is the bank of the program, from 0 to 16383
+	Bank int
+}
+
+// Setup returns the bank select and program change that choose the
+// instrument of the voice, or nothing when it has no program
+func (v Voice) Setup() (events []Event) {
+	if v.Program <= 0 {
+		return
+	}
+	channel := v.Channel & 0x0F
+	return []Event{
+		{Status: 0xB0 | channel, Data1: 0, Data2: (v.Bank >> 7) & 0x7F},
+		{Status: 0xB0 | channel, Data1: 32, Data2: v.Bank & 0x7F},
+		{Status: 0xC0 | channel, Data1: (v.Program - 1) & 0x7F},
+	}
+}
+
+// String returns the voice as it is parsed by ParseVoice
+func (v Voice) String() string {
+	return fmt.Sprintf("%d:%d:%d", v.Channel+1, v.Program, v.Bank)
+}
+
+// ParseVoice reads a voice written as "channel[:program[:bank]]",
+// where the channel counts from 1 like on most keyboards
+func ParseVoice(s string) (v Voice, err error) {
+	fields := strings.Split(s, ":")
+	if len(fields) > 3 {
+		return v, fmt.Errorf("voice %q should be channel[:program[:bank]]", s)
+	}
+	values := make([]int, 3)
+	for i, field := range fields {
+		values[i], err = strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return v, fmt.Errorf("voice %q should be channel[:program[:bank]]", s)
+		}
+	}
+	v = Voice{Channel: values[0] - 1, Program: values[1], Bank: values[2]}
+	if v.Channel < 0 || v.Channel > 15 {
+		err = fmt.Errorf("channel of voice %q should be from 1 to 16", s)
+	} else if v.Program < 0 || v.Program > 128 {
+		err = fmt.Errorf("program of voice %q should be from 1 to 128", s)
+	} else if v.Bank < 0 || v.Bank > 0x3FFF {
+		err = fmt.Errorf("bank of voice %q should be from 0 to 16383", s)
+	}
+	return
+}
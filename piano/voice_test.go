@@ -0,0 +1,55 @@
+package piano
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseVoice(t *testing.T) {
+	tests := []struct {
+		s     string
+		voice Voice
+		err   bool
+	}{
+		{"1", Voice{Channel: 0}, false},
+		{"10", Voice{Channel: 9}, false},
+		{"2:41", Voice{Channel: 1, Program: 41}, false},
+		{"16:1:129", Voice{Channel: 15, Program: 1, Bank: 129}, false},
+		{"0", Voice{}, true},
+		{"17", Voice{}, true},
+		{"2:129", Voice{}, true},
+		{"2:1:-1", Voice{}, true},
+		{"piano", Voice{}, true},
+		{"1:2:3:4", Voice{}, true},
+	}
+	for _, test := range tests {
+		voice, err := ParseVoice(test.s)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %+v", test.s, voice)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.s, err)
+		} else if voice != test.voice {
+			t.Errorf("%q: got %+v, expected %+v", test.s, voice, test.voice)
+		} else if again, _ := ParseVoice(voice.String()); again != voice {
+			t.Errorf("%q: %s is parsed as %+v", test.s, voice, again)
+		}
+	}
+}
+
+func TestVoiceSetup(t *testing.T) {
+	if events := (Voice{Channel: 3}).Setup(); len(events) != 0 {
+		t.Errorf("voice without program sent %+v", events)
+	}
+	expected := []Event{
+		{Status: 0xB3, Data1: 0, Data2: 1},
+		{Status: 0xB3, Data1: 32, Data2: 2},
+		{Status: 0xC3, Data1: 40},
+	}
+	if events := (Voice{Channel: 3, Program: 41, Bank: 130}).Setup(); !reflect.DeepEqual(events, expected) {
+		t.Errorf("got %+v, expected %+v", events, expected)
+	}
+}
@@ -0,0 +1,213 @@
+package piano
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrDisconnected is returned when writing to a device that is unplugged
+var ErrDisconnected = errors.New("MIDI device is disconnected")
+
+// Watcher keeps a device connected. It opens the device once it is
+// plugged in, and when the device goes away it keeps trying to open
+// it again, while its events keep coming from the same channel.
+type Watcher struct {
+	// Connect returns a new device to try to open
+	Connect func() Device
+	// Interval is the time between attempts to open the device
+	Interval time.Duration
+	// OnConnect, when set, is called after the device is
+	// opened and after it is disconnected
+	OnConnect func(connected bool)
+	// Plugged, when set, lists the ports that are plugged in, and the
+	// device is disconnected when its input port is not listed anymore.
+	// Some backends keep reading nothing from a port that is unplugged.
+	Plugged func() ([]DeviceInfo, error)
+
+	device  Device
+	events  chan Event
+	done    chan bool
+	stopped chan bool
+	sync.Mutex
+}
+
+// NewWatcher returns a watcher for the devices returned by connect
+func NewWatcher(connect func() Device) *Watcher {
+	return &Watcher{
+		Connect:  connect,
+		Interval: time.Second,
+	}
+}
+
+// Watch returns a watcher for the devices of the backend, with the
+// input and output ports that match the names (see NewDevice). It
+// waits for them while no port matches a name.
+func Watch(backendName, input, output string) (w *Watcher, err error) {
+	backend, err := getBackend(backendName)
+	if err != nil {
+		return
+	}
+	w = NewWatcher(func() Device {
+		return backend.New(input, output)
+	})
+	w.Plugged = backend.Plugged
+	return
+}
+
+// Open starts watching, it does not wait for the device to be plugged in
+func (w *Watcher) Open() (err error) {
+	w.events = make(chan Event, 1024)
+	w.done = make(chan bool)
+	w.stopped = make(chan bool)
+	go w.watch()
+	return
+}
+
+// watch opens the device and forwards its events until it is
+// disconnected, and then starts over
+func (w *Watcher) watch() {
+	logger := log.WithFields(log.Fields{
+		"function": "Watcher.watch",
+	})
+	defer close(w.stopped)
+	defer close(w.events)
+	plugged := w.Plugged
+	waiting := false
+	for {
+		device := w.Connect()
+		err := device.Open()
+		if err != nil {
+			// close it so that the next attempt sees new devices
+			device.Close()
+			if !waiting {
+				logger.Warnf("Waiting for MIDI device: %s", err.Error())
+				waiting = true
+			}
+			select {
+			case <-w.done:
+				return
+			case <-time.After(w.Interval):
+			}
+			continue
+		}
+		waiting = false
+		logger.Info("MIDI device connected")
+		w.setDevice(device)
+
+		poll := time.NewTicker(w.Interval)
+		connected := true
+		for connected {
+			select {
+			case <-w.done:
+				poll.Stop()
+				w.setDevice(nil)
+				device.Close()
+				return
+			case <-poll.C:
+				if plugged == nil {
+					break
+				}
+				devices, err := plugged()
+				if err != nil {
+					logger.Debugf("Cannot tell when the MIDI device is unplugged: %s", err.Error())
+					plugged = nil
+					break
+				}
+				connected = listed(devices, inputName(device))
+			case event, ok := <-device.Listen():
+				if !ok {
+					connected = false
+					break
+				}
+				select {
+				case w.events <- event:
+				case <-w.done:
+				}
+			}
+		}
+		poll.Stop()
+		logger.Warn("MIDI device disconnected")
+		w.setDevice(nil)
+		device.Close()
+	}
+}
+
+// listed returns whether the input port with the name is one of the
+// devices, which it is assumed to be when it has no name
+func listed(devices []DeviceInfo, name string) bool {
+	if name == "" {
+		return true
+	}
+	for _, info := range devices {
+		if info.Input && info.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// setDevice changes the current device and tells about it
+func (w *Watcher) setDevice(device Device) {
+	w.Lock()
+	w.device = device
+	w.Unlock()
+	if w.OnConnect != nil {
+		w.OnConnect(device != nil)
+	}
+}
+
+// Connected returns whether the device is connected
+func (w *Watcher) Connected() bool {
+	w.Lock()
+	defer w.Unlock()
+	return w.device != nil
+}
+
+// Listen returns the events of every device that is connected
+func (w *Watcher) Listen() <-chan Event {
+	return w.events
+}
+
+// Write sends the events to the device, if it is connected
+func (w *Watcher) Write(events []Event) (err error) {
+	w.Lock()
+	defer w.Unlock()
+	if w.device == nil {
+		return ErrDisconnected
+	}
+	return w.device.Write(events)
+}
+
+// Now returns the time of the clock of the connected device, or
+// 0 when it is disconnected or has no clock
+func (w *Watcher) Now() int64 {
+	w.Lock()
+	defer w.Unlock()
+	if clock, ok := w.device.(deviceClock); ok {
+		return clock.Now()
+	}
+	return 0
+}
+
+// InputName returns the name of the connected input device
+func (w *Watcher) InputName() string {
+	w.Lock()
+	defer w.Unlock()
+	if w.device == nil {
+		return ""
+	}
+	return inputName(w.device)
+}
+
+// Close stops watching and closes the device
+func (w *Watcher) Close() (err error) {
+	if w.done != nil {
+		close(w.done)
+		<-w.stopped
+		w.done = nil
+	}
+	return
+}
@@ -0,0 +1,91 @@
+package piano
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// unplugged is a device that cannot be opened
+type unplugged struct {
+	Loopback
+}
+
+func (d *unplugged) Open() error {
+	return errors.New("no device")
+}
+
+func TestWatcher(t *testing.T) {
+	var mutex sync.Mutex
+	var keyboard *Loopback
+	plugged := false
+	w := NewWatcher(func() Device {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !plugged {
+			return new(unplugged)
+		}
+		keyboard = NewLoopback()
+		return keyboard
+	})
+	w.Interval = 5 * time.Millisecond
+	connections := make(chan bool, 10)
+	w.OnConnect = func(connected bool) {
+		connections <- connected
+	}
+	if err := w.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write([]Event{{Status: 0x90, Data1: 60, Data2: 100}}); err != ErrDisconnected {
+		t.Errorf("writing without a device gave %v", err)
+	}
+
+	expectConnected := func(expected bool) {
+		select {
+		case connected := <-connections:
+			if connected != expected {
+				t.Fatalf("connected is %v, expected %v", connected, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("connected never became %v", expected)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		mutex.Lock()
+		plugged = true
+		mutex.Unlock()
+		expectConnected(true)
+
+		mutex.Lock()
+		current := keyboard
+		mutex.Unlock()
+		current.Play(Event{Status: 0x90, Data1: 60 + i, Data2: 100})
+		select {
+		case event := <-w.Listen():
+			if event.Data1 != 60+i {
+				t.Errorf("got %+v", event)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("event was not forwarded")
+		}
+		if err := w.Write([]Event{{Status: 0x80, Data1: 60 + i}}); err != nil {
+			t.Error(err)
+		}
+		if written := current.Written(); len(written) != 1 {
+			t.Errorf("device got %+v", written)
+		}
+
+		// unplugging closes the events of the device
+		mutex.Lock()
+		plugged = false
+		mutex.Unlock()
+		current.Close()
+		expectConnected(false)
+	}
+
+	w.Close()
+	if _, ok := <-w.Listen(); ok {
+		t.Error("events are still open after closing")
+	}
+}
@@ -0,0 +1,148 @@
+package player
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tempoStep is how many beats per minute ActionFaster
+// and ActionSlower change the tempo
+const tempoStep = 5
+
+// do does what the action asks for
+func (p *Player) do(action Action) {
+	logger := log.WithFields(log.Fields{
+		"function": "Player.do",
+	})
+	logger.Debugf("Doing %s", action)
+	switch action {
+	case ActionSave:
+		go p.save(p.BPM)
+	case ActionPlayback:
+		p.playback()
+	case ActionPanic:
+		p.silence()
+	case ActionTeach:
+		p.learn(false, 0)
+	case ActionImprovise:
+		p.learn(true, 0)
+	case ActionClear:
+		p.truncateHistory(0)
+		p.phrases = nil
+		p.phrase.reset()
+	case ActionUndo:
+		if len(p.phrases) == 0 {
+			logger.Info("No phrase to undo")
+			return
+		}
+		p.truncateHistory(p.phrases[len(p.phrases)-1])
+		p.phrases = p.phrases[:len(p.phrases)-1]
+		p.phrase.reset()
+	case ActionManual:
+		p.ManualAI = !p.ManualAI
+		logger.Infof("Manual AI: %v", p.ManualAI)
+	case ActionEngine:
+		p.cycleEngine()
+	case ActionFaster:
+		p.setTempo(p.BPM + tempoStep)
+	case ActionSlower:
+		p.setTempo(p.BPM - tempoStep)
+	case ActionReplay:
+		p.replay()
+	case ActionTap:
+		p.tap()
+	}
+}
+
+// truncateHistory keeps the first notes of the music history
+func (p *Player) truncateHistory(n int) {
+	logger := log.WithFields(log.Fields{
+		"function": "Player.truncateHistory",
+	})
+	removed := p.MusicHistory.Len() - n
+	err := p.MusicHistory.Truncate(n)
+	if err != nil {
+		logger.Error(err.Error())
+		p.publishError(err)
+		return
+	}
+	logger.Infof("Removed %d notes from the history", removed)
+}
+
+// setTempo changes the tempo of the clock, keeping the ticks per beat
+func (p *Player) setTempo(bpm int) {
+	logger := log.WithFields(log.Fields{
+		"function": "Player.setTempo",
+	})
+	hertz := p.TicksPerBeat * bpm / 60
+	if bpm == p.BPM {
+		return
+	}
+	if hertz < 1 {
+		logger.Warnf("%d bpm is too slow", bpm)
+		return
+	}
+	clock, ok := p.Clock.(interface {
+		SetHertz(hertz int)
+	})
+	if !ok {
+		logger.Warnf("The tempo of %T can not be changed", p.Clock)
+		return
+	}
+	clock.SetHertz(hertz)
+	p.tempoChanged(bpm)
+}
+
+// tempoChanged updates the player to the tempo of its clock,
+// which is changed by setTempo or by an external clock
+func (p *Player) tempoChanged(bpm int) {
+	logger := log.WithFields(log.Fields{
+		"function": "Player.tempoChanged",
+	})
+	hertz := p.TicksPerBeat * bpm / 60
+	if hertz < 1 {
+		return
+	}
+	p.BPM = bpm
+	p.ListeningRateHertz = hertz
+	p.timeline.reset(p.Tick, time.Now(), tickPeriod(hertz))
+	// the onsets were measured at the old tempo
+	p.onsets = nil
+	p.proposedBPM = 0
+	logger.Infof("BPM:  %d", p.BPM)
+	p.publish(Event{Kind: TempoChanged, Tick: p.Tick, BPM: bpm})
+}
+
+// relocate moves the player to the tick that its clock jumped to.
+// What was going to be played is dropped, and the rests of the
+// host are counted from the new tick.
+func (p *Player) relocate(tick int) {
+	logger := log.WithFields(log.Fields{
+		"function": "Player.relocate",
+	})
+	logger.Infof("Moving from tick %d to %d", p.Tick, tick)
+	p.silence()
+	p.setTick(tick)
+	p.timeline.reset(tick, time.Now(), 0)
+	p.lastNote = tick
+	p.LastHostPress = tick
+	// the next key of the host starts a new phrase
+	p.lastHostNote = tick - (p.BeatsOfSilence+1)*p.TicksPerBeat
+	p.phrase.reset()
+	p.onsets = nil
+}
+
+// replay plays the last improvisation again
+func (p *Player) replay() {
+	logger := log.WithFields(log.Fields{
+		"function": "Player.replay",
+	})
+	if p.state != Listening || p.lastLick == nil {
+		logger.Debugf("Not replaying while %s", p.state)
+		return
+	}
+	lick := p.playLick(p.lastLick, p.Tick+1)
+	logger.Infof("Replaying %d notes", lick.Len())
+	p.transition(Improvising)
+}
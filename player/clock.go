@@ -0,0 +1,292 @@
+package player
+
+import (
+	"sync"
+	"time"
+
+	"github.com/schollz/pianoai/piano"
+	log "github.com/sirupsen/logrus"
+)
+
+// PulsesPerBeat is the resolution of the MIDI clock
+const PulsesPerBeat = 24
+
+// Clock moves the player forward. It sends a position whenever it
+// is time to move.
+type Clock interface {
+	// Start starts the clock, with the resolution of the player
+	Start(ticksPerBeat int) <-chan Position
+	// Stop stops the clock and closes its channel
+	Stop()
+}
+
+// Position tells the player where to move
+type Position struct {
+	// Ticks is the number of ticks to move forward
+	Ticks int
+	// Jump moves the player to Tick instead, without playing the
+	// ticks in between, like when an external clock starts its
+	// song again or moves to a song position
+	Jump bool
+	Tick int
+	// BPM is the tempo of an external clock, or 0 when the
+	// clock goes at the tempo of the player
+	BPM int
+	// At is when the clock reached the position, or the zero
+	// time when the player takes the time it reads it
+	At time.Time
+	// Pulses is the number of MIDI clock pulses that the player
+	// sends at the position, so other instruments can follow it
+	Pulses int
+}
+
+// InternalClock moves forward one tick at a fixed rate
+type InternalClock struct {
+	// Hertz is the number of ticks per second
+	Hertz int
+
+	ticks chan Position
+	done  chan bool
+	rates chan int
+}
+
+// NewInternalClock returns a clock ticking at the rate
+func NewInternalClock(hertz int) *InternalClock {
+	return &InternalClock{Hertz: hertz}
+}
+
+// Start starts ticking
+func (c *InternalClock) Start(ticksPerBeat int) <-chan Position {
+	c.ticks = make(chan Position)
+	c.done = make(chan bool)
+	c.rates = make(chan int)
+	ticker := time.NewTicker(tickPeriod(c.Hertz))
+	go func() {
+		defer close(c.ticks)
+		defer func() {
+			ticker.Stop()
+		}()
+		for {
+			var at time.Time
+			select {
+			case <-c.done:
+				return
+			case hertz := <-c.rates:
+				ticker.Stop()
+				ticker = time.NewTicker(tickPeriod(hertz))
+				continue
+			case at = <-ticker.C:
+			}
+			select {
+			case <-c.done:
+				return
+			case hertz := <-c.rates:
+				ticker.Stop()
+				ticker = time.NewTicker(tickPeriod(hertz))
+			case c.ticks <- Position{Ticks: 1, At: at}:
+			}
+		}
+	}()
+	return c.ticks
+}
+
+// SetHertz changes the rate, also while it is ticking
+func (c *InternalClock) SetHertz(hertz int) {
+	c.Hertz = hertz
+	if c.rates == nil {
+		return
+	}
+	select {
+	case c.rates <- hertz:
+	case <-c.done:
+	}
+}
+
+// tickPeriod is the time between ticks at the rate
+func tickPeriod(hertz int) time.Duration {
+	return 1000 * time.Duration(1000000/hertz)
+}
+
+// Stop stops ticking
+func (c *InternalClock) Stop() {
+	close(c.done)
+}
+
+// MasterClock is an internal clock that has the player send MIDI
+// clock to the keyboard, so other instruments can follow the player.
+// The player sends it with the notes, see Player.sendClock.
+type MasterClock struct {
+	InternalClock
+
+	forwarded chan Position
+}
+
+// NewMasterClock returns a clock ticking at the rate, which
+// has the player send MIDI clock
+func NewMasterClock(hertz int) *MasterClock {
+	return &MasterClock{
+		InternalClock: InternalClock{Hertz: hertz},
+	}
+}
+
+// Start ticks like the internal clock, with a pulse every 1/24 beat
+func (c *MasterClock) Start(ticksPerBeat int) <-chan Position {
+	ticks := c.InternalClock.Start(ticksPerBeat)
+	c.forwarded = make(chan Position)
+	go func() {
+		defer close(c.forwarded)
+		tick, pulses := 0, 0
+		for position := range ticks {
+			tick += position.Ticks
+			// the pulses are spread over the beat, which
+			// is only exact when the ticks are a multiple of 24
+			for pulses*ticksPerBeat <= tick*PulsesPerBeat {
+				position.Pulses++
+				pulses++
+			}
+			select {
+			case c.forwarded <- position:
+			case <-c.done:
+			}
+		}
+	}()
+	return c.forwarded
+}
+
+// ExternalClock follows the MIDI clock of another instrument, like a
+// drum machine or a sequencer. It only moves while the instrument is
+// playing, and it moves the ticks of a beat for every 24 pulses.
+type ExternalClock struct {
+	ticksPerBeat int
+	running      bool
+	// pulses counts the pulses since the start of the song
+	pulses int
+	// sent is the tick of the pulses that were sent
+	sent int
+	// jump is set until the player is sent the new song position
+	jump bool
+	// lastPulse is the timestamp of the last pulse in milliseconds,
+	// and measured counts the pulses since the clock started
+	lastPulse int64
+	measured  int
+	// interval is the average time between pulses
+	interval time.Duration
+	bpm      int
+	ticks    chan Position
+	sync.Mutex
+}
+
+// NewExternalClock returns a clock that follows the MIDI clock
+// that it receives
+func NewExternalClock() *ExternalClock {
+	return new(ExternalClock)
+}
+
+// Start waits for the clock messages
+func (c *ExternalClock) Start(ticksPerBeat int) <-chan Position {
+	c.Lock()
+	defer c.Unlock()
+	c.ticksPerBeat = ticksPerBeat
+	c.ticks = make(chan Position, 1024)
+	return c.ticks
+}
+
+// Stop stops following the clock
+func (c *ExternalClock) Stop() {
+	c.Lock()
+	defer c.Unlock()
+	close(c.ticks)
+	c.ticks = nil
+}
+
+// BPM returns the tempo of the clock, or 0 if it is not known yet
+func (c *ExternalClock) BPM() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.bpm
+}
+
+// Receive handles the clock, start, stop, continue and
+// song position messages
+func (c *ExternalClock) Receive(event piano.Event) {
+	logger := log.WithFields(log.Fields{
+		"function": "ExternalClock.Receive",
+	})
+	c.Lock()
+	defer c.Unlock()
+	if c.ticks == nil {
+		return
+	}
+	switch event.Status {
+	case 0xFA:
+		logger.Info("Clock started")
+		c.running = true
+		c.pulses = 0
+		c.jump = true
+		c.measured = 0
+		c.send()
+	case 0xFB:
+		logger.Info("Clock continued")
+		c.running = true
+		c.measured = 0
+	case 0xFC:
+		logger.Info("Clock stopped")
+		c.running = false
+	case 0xF2:
+		// the song position counts 16th notes, which are 6 pulses
+		c.pulses = (event.Data1 | event.Data2<<7) * 6
+		c.jump = true
+		c.send()
+	case 0xF8:
+		if !c.running {
+			return
+		}
+		c.measure(logger, event.Timestamp)
+		c.pulses++
+		c.send()
+	}
+}
+
+// send moves the player to the pulses, the lock must be held. When
+// the player is behind, they are sent together with the next pulse.
+func (c *ExternalClock) send() {
+	tick := c.pulses * c.ticksPerBeat / PulsesPerBeat
+	position := Position{Ticks: tick - c.sent, BPM: c.bpm, At: time.Now()}
+	if c.jump {
+		position = Position{Jump: true, Tick: tick, BPM: c.bpm}
+	} else if tick <= c.sent {
+		return
+	}
+	select {
+	case c.ticks <- position:
+		c.sent = tick
+		c.jump = false
+	default:
+	}
+}
+
+// measure updates the tempo with the timestamp of the pulse, which
+// does not depend on when the pulse is read. The tempo is only
+// changed once it was measured over a beat.
+func (c *ExternalClock) measure(logger *log.Entry, timestamp int64) {
+	previous := c.lastPulse
+	c.lastPulse = timestamp
+	c.measured++
+	if c.measured == 1 {
+		return
+	}
+	interval := time.Duration(timestamp-previous) * time.Millisecond
+	if c.interval == 0 {
+		c.interval = interval
+	} else {
+		c.interval = (7*c.interval + interval) / 8
+	}
+	if c.measured < PulsesPerBeat || c.interval <= 0 {
+		return
+	}
+	bpm := int(float64(time.Minute)/float64(c.interval*PulsesPerBeat) + 0.5)
+	if bpm-c.bpm > 1 || c.bpm-bpm > 1 {
+		logger.Infof("Clock is at %d bpm", bpm)
+		c.bpm = bpm
+	}
+}
@@ -0,0 +1,203 @@
+package player
+
+import (
+	"testing"
+	"time"
+
+	"github.com/schollz/pianoai/piano"
+)
+
+// received sums the ticks that are waiting on the channel, after
+// the last jump, which is -1 when there is none
+func received(ticks <-chan Position) (sum, jump int) {
+	jump = -1
+	for {
+		select {
+		case position := <-ticks:
+			sum += position.Ticks
+			if position.Jump {
+				sum = 0
+				jump = position.Tick
+			}
+		default:
+			return
+		}
+	}
+}
+
+func TestExternalClock(t *testing.T) {
+	c := NewExternalClock()
+	ticks := c.Start(50)
+	defer c.Stop()
+	// the pulses are a millisecond apart on the device
+	var timestamp int64
+	pulse := func(n int) {
+		for i := 0; i < n; i++ {
+			timestamp++
+			c.Receive(piano.Event{Status: 0xF8, Timestamp: timestamp})
+		}
+	}
+
+	pulse(24)
+	if sum, jump := received(ticks); sum != 0 || jump != -1 {
+		t.Errorf("moved %d ticks before starting", sum)
+	}
+	c.Receive(piano.Event{Status: 0xFA})
+	pulse(24)
+	if sum, jump := received(ticks); sum != 50 || jump != 0 {
+		t.Errorf("moved %d ticks in a beat from tick %d", sum, jump)
+	}
+	if c.BPM() == 0 {
+		t.Error("tempo was not measured")
+	}
+	c.Receive(piano.Event{Status: 0xFC})
+	pulse(10)
+	if sum, _ := received(ticks); sum != 0 {
+		t.Errorf("moved %d ticks while stopped", sum)
+	}
+	// two beats into the song
+	c.Receive(piano.Event{Status: 0xF2, Data1: 8})
+	c.Receive(piano.Event{Status: 0xFB})
+	pulse(12)
+	if sum, jump := received(ticks); sum != 25 || jump != 100 {
+		t.Errorf("moved %d ticks in half a beat from tick %d", sum, jump)
+	}
+}
+
+func TestInternalClockSetHertz(t *testing.T) {
+	c := NewInternalClock(1)
+	ticks := c.Start(100)
+	c.SetHertz(1000)
+	timeout := time.After(time.Second)
+	for sum := 0; sum < 50; {
+		select {
+		case position := <-ticks:
+			sum += position.Ticks
+		case <-timeout:
+			t.Fatalf("only %d ticks after changing the rate", sum)
+		}
+	}
+	c.Stop()
+	for range ticks {
+	}
+}
+
+func TestMasterClock(t *testing.T) {
+	c := NewMasterClock(1000)
+	ticks := c.Start(48)
+	sum, pulses := 0, 0
+	for sum < 96 {
+		position := <-ticks
+		sum += position.Ticks
+		pulses += position.Pulses
+	}
+	c.Stop()
+	for range ticks {
+	}
+	// one pulse at the start, and 24 for each beat
+	if pulses != 49 {
+		t.Errorf("sent %d pulses in 2 beats", pulses)
+	}
+}
+
+func TestPlayerSendsClock(t *testing.T) {
+	device := piano.NewLoopback()
+	p, cleanup := startTestPlayer(t, device, func(p *Player) {
+		p.Clock = NewMasterClock(p.ListeningRateHertz)
+		p.Click = true
+	})
+	if !waitFor(func() bool { return p.CurrentTick() > 2*p.TicksPerBeat }) {
+		t.Fatal("player did not start")
+	}
+	cleanup()
+
+	written := device.Written()
+	if written[0].Status != 0xFA {
+		t.Errorf("clock did not start: %+v", written[0])
+	}
+	// the clock goes out with the clicks, stamped with their tick,
+	// so there is a pulse at the time of every click, give or take
+	// the rounding to milliseconds
+	pulses := make(map[int64]bool)
+	var clicks []int64
+	stopped := false
+	for _, event := range written {
+		switch event.Status {
+		case 0xF8:
+			if stopped {
+				t.Error("clock pulsed after it stopped")
+			}
+			pulses[event.Timestamp] = true
+		case 0x99:
+			clicks = append(clicks, event.Timestamp)
+		case 0xFC:
+			stopped = true
+		}
+	}
+	if !stopped {
+		t.Error("clock did not stop")
+	}
+	if len(clicks) == 0 {
+		t.Error("there were no clicks")
+	}
+	for _, click := range clicks {
+		if !pulses[click-1] && !pulses[click] && !pulses[click+1] {
+			t.Errorf("no pulse at the click at %d", click)
+		}
+	}
+}
+
+func TestPlayerFollowsClock(t *testing.T) {
+	device := piano.NewLoopback()
+	clock := NewExternalClock()
+	p, cleanup := startTestPlayer(t, device, func(p *Player) {
+		p.Clock = clock
+	})
+	defer cleanup()
+	events, cancel := p.Subscribe()
+	defer cancel()
+	pulse := func(n int) {
+		for i := 0; i < n; i++ {
+			device.Play(piano.Event{Status: 0xF8})
+			// 500 bpm
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	device.Play(piano.Event{Status: 0xFA})
+	pulse(48)
+	if !waitFor(func() bool { return p.CurrentTick() == 2*p.TicksPerBeat }) {
+		t.Errorf("player is at tick %d, expected %d", p.CurrentTick(), 2*p.TicksPerBeat)
+	}
+	// the tempo of the clock is the tempo of the player
+	bpm := 0
+	for bpm == 0 {
+		select {
+		case event := <-events:
+			if event.Kind == TempoChanged {
+				bpm = event.BPM
+			}
+		case <-time.After(time.Second):
+			t.Fatal("tempo did not change")
+		}
+	}
+	if bpm < 300 || bpm > 520 {
+		t.Errorf("player is at %d bpm, expected 500", bpm)
+	}
+
+	// the song moves to its fifth beat, and plays another one
+	device.Play(piano.Event{Status: 0xFC})
+	device.Play(piano.Event{Status: 0xF2, Data1: 16})
+	device.Play(piano.Event{Status: 0xFB})
+	pulse(24)
+	if !waitFor(func() bool { return p.CurrentTick() == 5*p.TicksPerBeat }) {
+		t.Errorf("player is at tick %d, expected %d", p.CurrentTick(), 5*p.TicksPerBeat)
+	}
+	// and starts again
+	device.Play(piano.Event{Status: 0xFC})
+	device.Play(piano.Event{Status: 0xFA})
+	pulse(24)
+	if !waitFor(func() bool { return p.CurrentTick() == p.TicksPerBeat }) {
+		t.Errorf("player is at tick %d, expected %d", p.CurrentTick(), p.TicksPerBeat)
+	}
+}
@@ -0,0 +1,371 @@
+package player
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/schollz/pianoai/music"
+)
+
+// Action is something the player can be asked to do from the keyboard
+type Action int
+
+const (
+	// ActionSave saves the music history, and a MIDI file next to it
+	ActionSave Action = iota
+	// ActionPlayback plays back the music history
+	ActionPlayback
+	// ActionPanic stops everything that is playing
+	ActionPanic
+	// ActionTeach lets the AI learn from the music history
+	ActionTeach
+	// ActionImprovise asks the AI for an improvisation
+	ActionImprovise
+	// ActionClear removes everything from the music history
+	ActionClear
+	// ActionUndo removes the last phrase that was played from the music history
+	ActionUndo
+	// ActionManual turns the manual mode on and off, see ManualAI
+	ActionManual
+	// ActionEngine improvises with the next of the Engines
+	ActionEngine
+	// ActionFaster raises the tempo
+	ActionFaster
+	// ActionSlower lowers the tempo
+	ActionSlower
+	// ActionReplay plays the last improvisation again
+	ActionReplay
+	// ActionTap sets the tempo to the time between the last taps
+	ActionTap
+)
+
+// actionNames are the names of the actions in control maps
+var actionNames = []string{
+	ActionSave:      "save",
+	ActionPlayback:  "playback",
+	ActionPanic:     "panic",
+	ActionTeach:     "teach",
+	ActionImprovise: "improvise",
+	ActionClear:     "clear",
+	ActionUndo:      "undo",
+	ActionManual:    "manual",
+	ActionEngine:    "engine",
+	ActionFaster:    "faster",
+	ActionSlower:    "slower",
+	ActionReplay:    "replay",
+	ActionTap:       "tap",
+}
+
+func (a Action) String() string {
+	if a < 0 || int(a) >= len(actionNames) {
+		return "unknown"
+	}
+	return actionNames[a]
+}
+
+// ParseAction returns the action with the name
+func ParseAction(name string) (a Action, err error) {
+	for i, actionName := range actionNames {
+		if strings.EqualFold(strings.TrimSpace(name), actionName) {
+			return Action(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown action %q, expected one of %s", name, strings.Join(actionNames, ", "))
+}
+
+// pedalNames are the controllers of the pedals
+var pedalNames = map[string]int{
+	"sustain":   music.SustainPedal,
+	"sostenuto": music.SostenutoPedal,
+	"soft":      music.SoftPedal,
+}
+
+// Binding is what triggers an action: keys that are pressed
+// together, or a control change like a pedal
+type Binding struct {
+	// Notes are the pitches of the keys. A key of its own only
+	// triggers the action, while the keys of a combination are only
+	// kept from the recording when they are pressed together
+	Notes []int
+	// Controller is the number of the control change, when there are no Notes
+	Controller int
+	// Value of the control change, or 0 for any value from 64 up,
+	// like a pedal that is pressed
+	Value int
+}
+
+// IsZero returns whether nothing triggers the action
+func (b Binding) IsZero() bool {
+	return len(b.Notes) == 0 && b.Controller == 0
+}
+
+func (b Binding) String() string {
+	switch {
+	case len(b.Notes) > 0:
+		pitches := make([]string, len(b.Notes))
+		for i, pitch := range b.Notes {
+			pitches[i] = strconv.Itoa(pitch)
+		}
+		return strings.Join(pitches, "+")
+	case b.Controller == 0:
+		return "none"
+	case b.Value > 0:
+		return fmt.Sprintf("cc%d=%d", b.Controller, b.Value)
+	}
+	for name, controller := range pedalNames {
+		if controller == b.Controller {
+			return name
+		}
+	}
+	return fmt.Sprintf("cc%d", b.Controller)
+}
+
+// ParseBinding reads a binding, which is a key ("21"), keys pressed
+// together ("21+23"), a pedal ("sustain", "sostenuto" or "soft"), a
+// control change pressed like a pedal ("cc20"), a control change with
+// a value ("cc20=127"), or "none"
+func ParseBinding(s string) (b Binding, err error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "none" {
+		return
+	}
+	if controller, ok := pedalNames[s]; ok {
+		b.Controller = controller
+		return
+	}
+	if strings.HasPrefix(s, "cc") {
+		fields := strings.SplitN(strings.TrimPrefix(s, "cc"), "=", 2)
+		b.Controller, err = strconv.Atoi(fields[0])
+		if err == nil && len(fields) == 2 {
+			b.Value, err = strconv.Atoi(fields[1])
+		}
+		if err != nil || b.Controller < 1 || b.Controller > 127 || b.Value < 0 || b.Value > 127 {
+			return Binding{}, fmt.Errorf("bad control change %q, expected cc<1-127>[=<0-127>]", s)
+		}
+		return
+	}
+	for _, field := range strings.Split(s, "+") {
+		pitch, errPitch := strconv.Atoi(strings.TrimSpace(field))
+		if errPitch != nil || pitch < 0 || pitch > 127 {
+			return Binding{}, fmt.Errorf("bad key %q in %q, expected a pitch from 0 to 127", field, s)
+		}
+		b.Notes = append(b.Notes, pitch)
+	}
+	return
+}
+
+// ControlMap binds actions to the keyboard
+type ControlMap map[Action]Binding
+
+// DefaultControls returns the keys at the ends of an 88-key keyboard
+func DefaultControls() ControlMap {
+	return ControlMap{
+		ActionSave:      {Notes: []int{21}},
+		ActionPlayback:  {Notes: []int{22}},
+		ActionPanic:     {Notes: []int{23}},
+		ActionTeach:     {Notes: []int{107}},
+		ActionImprovise: {Notes: []int{108}},
+	}
+}
+
+// Set binds an action, as in "improvise=cc20" (see ParseBinding)
+func (c ControlMap) Set(s string) (err error) {
+	fields := strings.SplitN(s, "=", 2)
+	if len(fields) != 2 {
+		return fmt.Errorf("bad control %q, expected action=binding", s)
+	}
+	action, err := ParseAction(fields[0])
+	if err != nil {
+		return
+	}
+	binding, err := ParseBinding(fields[1])
+	if err != nil {
+		return
+	}
+	if binding.IsZero() {
+		delete(c, action)
+	} else {
+		c[action] = binding
+	}
+	return
+}
+
+// Load binds the actions of a JSON file, which maps the names of
+// the actions to their bindings, like {"improvise": "cc20"}
+func (c ControlMap) Load(filename string) (err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	var bindings map[string]string
+	err = json.Unmarshal(data, &bindings)
+	if err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+	names := make([]string, 0, len(bindings))
+	for name := range bindings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err = c.Set(name + "=" + bindings[name])
+		if err != nil {
+			return fmt.Errorf("%s: %s", filename, err)
+		}
+	}
+	return
+}
+
+// combinationWindow is how long the first keys of a combination wait
+// for the others, before they are played like any other key
+const combinationWindow = 80 * time.Millisecond
+
+// controls keeps track of the keys and controllers of the keyboard,
+// to find the actions that they trigger
+type controls struct {
+	// values are the last values of the controllers
+	values map[int]int
+	// waiting are the keys of combinations that are held back until
+	// the rest of the combination is pressed, since the first of them
+	waiting []music.Note
+	since   time.Time
+	// used are the keys that completed a combination, which are not
+	// played when they are released either
+	used map[int]bool
+}
+
+// match returns the actions that the note triggers, and the notes that
+// are played: the keys of combinations that are not waited for anymore,
+// and the note unless it is only meant for the controls
+func (c *controls) match(controlMap ControlMap, note music.Note) (actions []Action, played []music.Note) {
+	if c.values == nil {
+		c.values = make(map[int]int)
+		c.used = make(map[int]bool)
+	}
+	switch {
+	case note.Kind == music.ControlEvent:
+		previous := c.values[note.Pitch]
+		c.values[note.Pitch] = note.Velocity
+		consumed := false
+		for action := Action(0); int(action) < len(actionNames); action++ {
+			binding, ok := controlMap[action]
+			if !ok || len(binding.Notes) > 0 || binding.Controller != note.Pitch {
+				continue
+			}
+			consumed = true
+			if binding.Value == 0 && previous < 64 && note.Velocity >= 64 ||
+				binding.Value > 0 && previous != binding.Value && note.Velocity == binding.Value {
+				actions = append(actions, action)
+			}
+		}
+		if consumed {
+			return
+		}
+	case note.IsNote() && !note.On:
+		if c.used[note.Pitch] {
+			delete(c.used, note.Pitch)
+			return
+		}
+		if c.bound(controlMap, note.Pitch, false) {
+			return
+		}
+	case note.IsNote():
+		for action := Action(0); int(action) < len(actionNames); action++ {
+			binding, ok := controlMap[action]
+			if ok && len(binding.Notes) == 1 && binding.Notes[0] == note.Pitch {
+				actions = append(actions, action)
+			}
+		}
+		if len(actions) > 0 {
+			return
+		}
+		for action := Action(0); int(action) < len(actionNames); action++ {
+			binding, ok := controlMap[action]
+			if !ok || len(binding.Notes) < 2 || !hasPitch(binding.Notes, note.Pitch) || !c.awaits(binding.Notes, note.Pitch) {
+				continue
+			}
+			actions = append(actions, action)
+			for _, pitch := range binding.Notes {
+				c.used[pitch] = true
+			}
+		}
+		if len(actions) > 0 {
+			// the other keys that were held back are played
+			var waiting []music.Note
+			for _, held := range c.waiting {
+				if !c.used[held.Pitch] {
+					waiting = append(waiting, held)
+				}
+			}
+			c.waiting = nil
+			return actions, waiting
+		}
+		if c.bound(controlMap, note.Pitch, true) {
+			if len(c.waiting) == 0 {
+				c.since = time.Now()
+			}
+			c.waiting = append(c.waiting, note)
+			return
+		}
+	}
+	return nil, append(c.flush(), note)
+}
+
+// expire returns the keys that waited too long for the rest of their
+// combination, so they are played after all
+func (c *controls) expire(now time.Time) (played []music.Note) {
+	if len(c.waiting) == 0 || now.Sub(c.since) < combinationWindow {
+		return
+	}
+	return c.flush()
+}
+
+// flush returns the keys that are held back, and stops waiting for them
+func (c *controls) flush() (played []music.Note) {
+	played = c.waiting
+	c.waiting = nil
+	return
+}
+
+// bound returns whether the pitch is a key of its own, or a key of a
+// combination when combined is true
+func (c *controls) bound(controlMap ControlMap, pitch int, combined bool) bool {
+	for _, binding := range controlMap {
+		if (len(binding.Notes) > 1) == combined && hasPitch(binding.Notes, pitch) {
+			return true
+		}
+	}
+	return false
+}
+
+// awaits returns whether all the keys but the pitch are held back
+func (c *controls) awaits(pitches []int, pitch int) bool {
+	for _, p := range pitches {
+		if p == pitch {
+			continue
+		}
+		waiting := false
+		for _, held := range c.waiting {
+			waiting = waiting || held.Pitch == p
+		}
+		if !waiting {
+			return false
+		}
+	}
+	return true
+}
+
+// hasPitch returns whether the pitch is one of the pitches
+func hasPitch(pitches []int, pitch int) bool {
+	for _, p := range pitches {
+		if p == pitch {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package player
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/schollz/pianoai/music"
+	"github.com/schollz/pianoai/piano"
+)
+
+func TestParseBinding(t *testing.T) {
+	for s, expected := range map[string]Binding{
+		"21":       {Notes: []int{21}},
+		"21 + 23":  {Notes: []int{21, 23}},
+		"sustain":  {Controller: music.SustainPedal},
+		"Soft":     {Controller: music.SoftPedal},
+		"cc20":     {Controller: 20},
+		"cc20=127": {Controller: 20, Value: 127},
+		"none":     {},
+	} {
+		b, err := ParseBinding(s)
+		if err != nil {
+			t.Errorf("%s: %s", s, err)
+		} else if !reflect.DeepEqual(b, expected) {
+			t.Errorf("%s is %+v, expected %+v", s, b, expected)
+		}
+	}
+	for _, s := range []string{"", "c", "128", "21+", "cc", "cc200", "cc20=200"} {
+		if _, err := ParseBinding(s); err == nil {
+			t.Errorf("%q was parsed", s)
+		}
+	}
+	if s := (Binding{Controller: music.SostenutoPedal}).String(); s != "sostenuto" {
+		t.Errorf("pedal is %s", s)
+	}
+}
+
+func TestControlMapLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "player")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "controls.json")
+	ioutil.WriteFile(filename, []byte(`{"improvise": "cc20", "save": "none", "undo": "36+38"}`), 0644)
+
+	c := DefaultControls()
+	if err = c.Load(filename); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set("replay=sustain"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c[ActionSave]; ok {
+		t.Error("save is still bound")
+	}
+	if c[ActionImprovise].Controller != 20 || c[ActionTeach].Notes[0] != 107 {
+		t.Errorf("controls are %+v", c)
+	}
+	if !reflect.DeepEqual(c[ActionUndo].Notes, []int{36, 38}) || c[ActionReplay].Controller != music.SustainPedal {
+		t.Errorf("controls are %+v", c)
+	}
+	if err = c.Set("dance=21"); err == nil {
+		t.Error("unknown action was bound")
+	}
+}
+
+func TestControlsMatch(t *testing.T) {
+	controlMap := ControlMap{
+		ActionPanic:    {Notes: []int{23}},
+		ActionUndo:     {Notes: []int{36, 38}},
+		ActionReplay:   {Controller: music.SoftPedal},
+		ActionManual:   {Controller: 20, Value: 127},
+		ActionEngine:   {Controller: 20, Value: 1},
+		ActionFaster:   {Notes: []int{100}},
+		ActionSlower:   {Notes: []int{100, 101}},
+		ActionPlayback: {Controller: 21},
+	}
+	var c controls
+	lone := music.Note{On: true, Pitch: 36, Velocity: 80}
+	for i, test := range []struct {
+		note    music.Note
+		actions []Action
+		played  []music.Note
+	}{
+		{music.Note{On: true, Pitch: 23, Velocity: 90}, []Action{ActionPanic}, nil},
+		{music.Note{Pitch: 23}, nil, nil},
+		{music.Note{On: true, Pitch: 36, Velocity: 90}, nil, nil},
+		{music.Note{On: true, Pitch: 38, Velocity: 90}, []Action{ActionUndo}, nil},
+		{music.Note{Pitch: 38}, nil, nil},
+		{music.Note{Pitch: 36}, nil, nil},
+		// a key of a combination on its own is played when it is released
+		{lone, nil, nil},
+		{music.Note{Pitch: 36}, nil, []music.Note{lone, {Pitch: 36}}},
+		// the pedal is pressed once, even when it moves
+		{music.Note{Kind: music.ControlEvent, Pitch: music.SoftPedal, Velocity: 100}, []Action{ActionReplay}, nil},
+		{music.Note{Kind: music.ControlEvent, Pitch: music.SoftPedal, Velocity: 120}, nil, nil},
+		{music.Note{Kind: music.ControlEvent, Pitch: music.SoftPedal, Velocity: 0}, nil, nil},
+		{music.Note{Kind: music.ControlEvent, Pitch: 20, Velocity: 127}, []Action{ActionManual}, nil},
+		{music.Note{Kind: music.ControlEvent, Pitch: 20, Velocity: 1}, []Action{ActionEngine}, nil},
+		{music.Note{Kind: music.ControlEvent, Pitch: music.SustainPedal, Velocity: 127}, nil, []music.Note{{Kind: music.ControlEvent, Pitch: music.SustainPedal, Velocity: 127}}},
+		// a key of its own, and a key of a combination
+		{music.Note{On: true, Pitch: 100, Velocity: 90}, []Action{ActionFaster}, nil},
+		{music.Note{On: true, Pitch: 101, Velocity: 90}, nil, nil},
+		// another key plays the key that was held back
+		{music.Note{On: true, Pitch: 60, Velocity: 90}, nil, []music.Note{{On: true, Pitch: 101, Velocity: 90}, {On: true, Pitch: 60, Velocity: 90}}},
+		{music.Note{Pitch: 101}, nil, []music.Note{{Pitch: 101}}},
+	} {
+		actions, played := c.match(controlMap, test.note)
+		if !reflect.DeepEqual(actions, test.actions) || !reflect.DeepEqual(played, test.played) {
+			t.Errorf("%d: %+v triggers %v and plays %+v, expected %v and %+v", i, test.note, actions, played, test.actions, test.played)
+		}
+	}
+
+	// a key of a combination is played when the others do not follow
+	c.match(controlMap, lone)
+	if played := c.expire(time.Now()); played != nil {
+		t.Errorf("%+v played right away", played)
+	}
+	played := c.expire(time.Now().Add(combinationWindow))
+	if !reflect.DeepEqual(played, []music.Note{lone}) {
+		t.Errorf("played %+v after waiting, expected %+v", played, lone)
+	}
+}
+
+func TestPlayerControls(t *testing.T) {
+	device := piano.NewLoopback()
+	p, cleanup := startTestPlayer(t, device, func(p *Player) {
+		p.Controls.Set("undo=cc20")
+	})
+	defer cleanup()
+
+	before := p.MusicHistory.Len()
+	device.Play(
+		piano.Event{Status: 0x90, Data1: 72, Data2: 100},
+		piano.Event{Status: 0x80, Data1: 72, Data2: 0},
+	)
+	if !waitFor(func() bool { return p.MusicHistory.Len() == before+2 }) {
+		t.Fatal("phrase was not recorded")
+	}
+	device.Play(piano.Event{Status: 0xB0, Data1: 20, Data2: 127})
+	if !waitFor(func() bool { return p.MusicHistory.Len() == before }) {
+		t.Errorf("history has %d notes after undoing, expected %d", p.MusicHistory.Len(), before)
+	}
+
+	// the undone notes are not recovered
+	history, err := music.Open(p.MusicHistoryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if history.Len() != before {
+		t.Errorf("saved %d notes, expected %d", history.Len(), before)
+	}
+}
+
+func TestPlayerUndoCombination(t *testing.T) {
+	device := piano.NewLoopback()
+	p, cleanup := startTestPlayer(t, device, func(p *Player) {
+		p.Controls.Set("undo=24+26")
+	})
+	defer cleanup()
+
+	before := p.MusicHistory.Len()
+	device.Play(
+		piano.Event{Status: 0x90, Data1: 72, Data2: 100},
+		piano.Event{Status: 0x80, Data1: 72, Data2: 0},
+	)
+	if !waitFor(func() bool { return p.MusicHistory.Len() == before+2 }) {
+		t.Fatal("phrase was not recorded")
+	}
+	// a pause, so the keys of the combination come after the phrase
+	time.Sleep(time.Duration(p.BeatsOfSilence+1) * time.Minute / time.Duration(p.BPM))
+	device.Play(
+		piano.Event{Status: 0x90, Data1: 24, Data2: 100},
+		piano.Event{Status: 0x90, Data1: 26, Data2: 100},
+		piano.Event{Status: 0x80, Data1: 24, Data2: 0},
+		piano.Event{Status: 0x80, Data1: 26, Data2: 0},
+	)
+	if !waitFor(func() bool { return p.MusicHistory.Len() == before }) {
+		t.Errorf("history has %d notes after undoing, expected %d", p.MusicHistory.Len(), before)
+	}
+	// the keys of the combination are not recorded
+	time.Sleep(2 * combinationWindow)
+	for _, note := range p.MusicHistory.GetAll() {
+		if note.Pitch == 24 || note.Pitch == 26 {
+			t.Errorf("%+v was recorded", note)
+		}
+	}
+
+	// but they can be played one at a time
+	device.Play(piano.Event{Status: 0x90, Data1: 24, Data2: 100})
+	time.Sleep(2 * combinationWindow)
+	device.Play(piano.Event{Status: 0x80, Data1: 24, Data2: 0})
+	recorded := func() (pressed, released bool) {
+		for _, note := range p.MusicHistory.GetAll() {
+			if note.Pitch == 24 {
+				pressed = pressed || note.On
+				released = released || !note.On
+			}
+		}
+		return
+	}
+	if !waitFor(func() bool { pressed, released := recorded(); return pressed && released }) {
+		pressed, released := recorded()
+		t.Errorf("key of the combination was recorded pressed %v and released %v", pressed, released)
+	}
+}
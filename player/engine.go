@@ -0,0 +1,55 @@
+package player
+
+import (
+	"fmt"
+
+	"github.com/schollz/pianoai/music"
+	log "github.com/sirupsen/logrus"
+)
+
+// Engine is an AI that learns from the music history and improvises,
+// like the AI of ai2 or the Engine of ai
+type Engine interface {
+	// Learn learns from the music
+	Learn(m *music.Music) error
+	// Lick improvises, starting at the tick
+	Lick(startBeat int) (*music.Music, error)
+}
+
+// engines returns the engines to choose from, which is
+// only the AI when there are no Engines
+func (p *Player) engines() []Engine {
+	if len(p.Engines) == 0 {
+		return []Engine{p.AI}
+	}
+	return p.Engines
+}
+
+// currentEngine returns the engine that improvises
+func (p *Player) currentEngine() Engine {
+	engines := p.engines()
+	return engines[p.engine%len(engines)]
+}
+
+// cycleEngine improvises with the next engine from now on
+func (p *Player) cycleEngine() {
+	p.engine = (p.engine + 1) % len(p.engines())
+	log.WithFields(log.Fields{
+		"function": "Player.cycleEngine",
+	}).Infof("Improvising with %T", p.currentEngine())
+}
+
+// improvise runs the engine, and returns an error
+// instead of crashing when the engine panics
+func improvise(engine Engine, history *music.Music, lick bool) (notes *music.Music, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%T failed: %v", engine, r)
+		}
+	}()
+	err = engine.Learn(history)
+	if err != nil || !lick {
+		return
+	}
+	return engine.Lick(0)
+}
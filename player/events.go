@@ -0,0 +1,150 @@
+package player
+
+import (
+	"time"
+
+	"github.com/schollz/pianoai/music"
+)
+
+// EventKind is the kind of an Event of the player
+type EventKind int
+
+const (
+	// HostNote is a note played by the host, that was recorded
+	HostNote EventKind = iota
+	// AINote is a note played by the player, from an
+	// improvisation of the AI or from the playback
+	AINote
+	// StateChange is a change of the State of the player
+	StateChange
+	// LickGenerated is an improvisation of the AI that will be played
+	LickGenerated
+	// HistorySaved is the music history being saved to a file
+	HistorySaved
+	// Error is something that went wrong
+	Error
+	// TempoEstimated is the tempo that the host seems to play at
+	TempoEstimated
+	// TempoChanged is a new tempo of the player
+	TempoChanged
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case HostNote:
+		return "host note"
+	case AINote:
+		return "ai note"
+	case StateChange:
+		return "state change"
+	case LickGenerated:
+		return "lick generated"
+	case HistorySaved:
+		return "history saved"
+	case Error:
+		return "error"
+	case TempoEstimated:
+		return "tempo estimated"
+	case TempoChanged:
+		return "tempo changed"
+	}
+	return "unknown"
+}
+
+// Event tells what the player is doing, see Subscribe. Only the
+// fields of its kind are set.
+type Event struct {
+	Kind EventKind
+	// Tick is when it happened, or when the note is played
+	Tick int
+	// Note is the note of HostNote and AINote
+	Note music.Note
+	// State and Previous are the states of StateChange
+	State    State
+	Previous State
+	// Lick is the improvisation of LickGenerated
+	Lick *Lick
+	// Filename is the file of HistorySaved
+	Filename string
+	// Err is the error of Error
+	Err error
+	// BPM is the tempo of TempoEstimated and TempoChanged
+	BPM int
+	// Confidence tells how sure the estimate of TempoEstimated
+	// is, from 0 to 1
+	Confidence float64
+}
+
+// Lick is an improvisation of the AI
+type Lick struct {
+	// Music are the notes, at the ticks they will be played
+	Music *music.Music
+	// Start and End are the first and last ticks of the notes
+	Start int
+	End   int
+	// Notes is the number of notes
+	Notes int
+	// Took is how long learning and improvising took
+	Took time.Duration
+	// Scale is how much the lick was stretched, so that the beats
+	// of the history it was learned from last as long as the beats
+	// of the player
+	Scale float64
+}
+
+// Subscribe returns a channel that receives the events of the
+// player, and a function to stop receiving them. Events are
+// dropped when the channel is full, so the player is never held
+// up by a slow subscriber. The channel is closed when the
+// player is closed, or when the subscription is cancelled.
+func (p *Player) Subscribe() (events <-chan Event, cancel func()) {
+	ch := make(chan Event, 256)
+	p.subscribers.Lock()
+	defer p.subscribers.Unlock()
+	if p.subscribers.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if p.subscribers.channels == nil {
+		p.subscribers.channels = make(map[chan Event]bool)
+	}
+	p.subscribers.channels[ch] = true
+	cancel = func() {
+		p.subscribers.Lock()
+		defer p.subscribers.Unlock()
+		if p.subscribers.channels[ch] {
+			delete(p.subscribers.channels, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+// publish sends the event to every subscriber, it is safe to
+// call from any thread
+func (p *Player) publish(event Event) {
+	p.subscribers.Lock()
+	defer p.subscribers.Unlock()
+	for ch := range p.subscribers.channels {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// publishError sends the error to every subscriber
+func (p *Player) publishError(err error) {
+	p.publish(Event{Kind: Error, Tick: p.CurrentTick(), Err: err})
+}
+
+// unsubscribeAll closes the channels of every subscriber
+func (p *Player) unsubscribeAll() {
+	p.subscribers.Lock()
+	defer p.subscribers.Unlock()
+	for ch := range p.subscribers.channels {
+		close(ch)
+	}
+	p.subscribers.channels = nil
+	p.subscribers.closed = true
+}
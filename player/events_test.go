@@ -0,0 +1,63 @@
+package player
+
+import (
+	"testing"
+	"time"
+
+	"github.com/schollz/pianoai/piano"
+)
+
+func TestSubscribe(t *testing.T) {
+	p, device, cleanup := newTestPlayer(t)
+	defer cleanup()
+	events, cancel := p.Subscribe()
+
+	device.Play(
+		piano.Event{Status: 0x90, Data1: 72, Data2: 100},
+		piano.Event{Status: 0x90, Data1: 108, Data2: 100},
+	)
+	seen := make(map[EventKind]Event)
+	timeout := time.After(5 * time.Second)
+	for len(seen) < 4 {
+		select {
+		case event := <-events:
+			if event.Kind == StateChange && event.State != Learning {
+				continue
+			}
+			if _, ok := seen[event.Kind]; !ok {
+				seen[event.Kind] = event
+			}
+		case <-timeout:
+			t.Fatalf("only received %v", seen)
+		}
+	}
+	if note := seen[HostNote].Note; note.Pitch != 72 || !note.On {
+		t.Errorf("host note is %+v", note)
+	}
+	if previous := seen[StateChange].Previous; previous != Listening {
+		t.Errorf("learning after %s, expected listening", previous)
+	}
+	lick := seen[LickGenerated].Lick
+	if lick == nil || lick.Notes == 0 || lick.Notes != lick.Music.Len() || lick.Start > lick.End {
+		t.Fatalf("lick is %+v", lick)
+	}
+	if tick := seen[AINote].Tick; tick < lick.Start || tick > lick.End {
+		t.Errorf("ai note at tick %d is not in the lick from %d to %d", tick, lick.Start, lick.End)
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestSubscribeAfterClose(t *testing.T) {
+	p, _, cleanup := newTestPlayer(t)
+	events, _ := p.Subscribe()
+	cleanup()
+	for range events {
+	}
+	events, _ = p.Subscribe()
+	if _, ok := <-events; ok {
+		t.Error("subscribed to a closed player")
+	}
+}
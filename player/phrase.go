@@ -0,0 +1,278 @@
+package player
+
+import (
+	"math"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// minPhraseNotes is how many keys make a phrase to answer
+	minPhraseNotes = 3
+	// restIntervals is how many of the usual intervals between the
+	// keys of a phrase make a rest long enough to end it, without
+	// any other sign that the phrase ended
+	restIntervals = 2
+	// endingBonus is how much shorter the rest can be for each
+	// sign that the phrase ended, as a part of that rest
+	endingBonus = 0.25
+)
+
+// phraseNote is a key of a phrase, which is still held
+// while its end is before its start
+type phraseNote struct {
+	pitch int
+	start int
+	end   int
+}
+
+// phrase is what the host played since the last pause, to find
+// out when the host is done, and how long the answer should be
+type phrase struct {
+	notes []phraseNote
+	// answered is set once the AI answered the phrase
+	answered bool
+}
+
+// reset starts a new phrase
+func (ph *phrase) reset() {
+	ph.notes = nil
+	ph.answered = false
+}
+
+// add presses or releases a key of the phrase
+func (ph *phrase) add(pitch, tick int, on bool) {
+	if on {
+		ph.notes = append(ph.notes, phraseNote{pitch: pitch, start: tick, end: -1})
+		return
+	}
+	for i := len(ph.notes) - 1; i >= 0; i-- {
+		if ph.notes[i].pitch == pitch && ph.notes[i].end < ph.notes[i].start {
+			ph.notes[i].end = tick
+			return
+		}
+	}
+}
+
+// last returns the tick of the last key that was pressed or released
+func (ph *phrase) last() (tick int) {
+	for _, note := range ph.notes {
+		if note.start > tick {
+			tick = note.start
+		}
+		if note.end > tick {
+			tick = note.end
+		}
+	}
+	return
+}
+
+// length returns the ticks from the first key to the last
+func (ph *phrase) length() int {
+	if len(ph.notes) == 0 {
+		return 0
+	}
+	return ph.last() - ph.notes[0].start
+}
+
+// onsets returns the ticks of the keys, counting chords once
+func (ph *phrase) onsets(beat int) []int {
+	onsets := make([]int, len(ph.notes))
+	for i, note := range ph.notes {
+		onsets[i] = note.start
+	}
+	return mergeChords(onsets, float64(beat)/16)
+}
+
+// interval returns the usual time between the keys, or a
+// beat when there are too few keys to tell
+func (ph *phrase) interval(beat int) float64 {
+	onsets := ph.onsets(beat)
+	if len(onsets) < 2 {
+		return float64(beat)
+	}
+	intervals := make([]int, len(onsets)-1)
+	for i := range intervals {
+		intervals[i] = onsets[i+1] - onsets[i]
+	}
+	return float64(median(intervals))
+}
+
+// ending returns the keys pressed together at the end of the phrase
+func (ph *phrase) ending(beat int) (notes []phraseNote) {
+	onsets := ph.onsets(beat)
+	if len(onsets) == 0 {
+		return
+	}
+	for _, note := range ph.notes {
+		if note.start >= onsets[len(onsets)-1] {
+			notes = append(notes, note)
+		}
+	}
+	return
+}
+
+// cadence returns whether the phrase comes to rest on a stable pitch:
+// the lowest key of the end is the tonic of the phrase, which is the
+// pitch class that sounds the longest, or its fifth
+func (ph *phrase) cadence(beat int) bool {
+	ending := ph.ending(beat)
+	if len(ph.notes) < minPhraseNotes || len(ending) == 0 {
+		return false
+	}
+	last := ph.last()
+	var weights [12]int
+	for _, note := range ph.notes {
+		end := note.end
+		if end < note.start {
+			end = last
+		}
+		weights[note.pitch%12] += end - note.start + 1
+	}
+	tonic := 0
+	for pitchClass, weight := range weights {
+		if weight > weights[tonic] {
+			tonic = pitchClass
+		}
+	}
+	bass := ending[0].pitch
+	for _, note := range ending {
+		if note.pitch < bass {
+			bass = note.pitch
+		}
+	}
+	return bass%12 == tonic || bass%12 == (tonic+7)%12
+}
+
+// longEnding returns whether the end of the phrase is held
+// longer than the other keys usually are
+func (ph *phrase) longEnding(beat int) bool {
+	var durations []int
+	for _, note := range ph.notes {
+		if note.end >= note.start {
+			durations = append(durations, note.end-note.start)
+		}
+	}
+	if len(durations) < minPhraseNotes {
+		return false
+	}
+	usual := median(durations)
+	for _, note := range ph.ending(beat) {
+		if note.end >= note.start && float64(note.end-note.start) >= 1.5*float64(usual) {
+			return true
+		}
+	}
+	return false
+}
+
+// onBar returns whether the phrase ends on the first beat of a bar,
+// or lasts about a whole number of bars
+func (ph *phrase) onBar(beat, bar int) bool {
+	onsets := ph.onsets(beat)
+	if len(onsets) == 0 || bar <= 0 {
+		return false
+	}
+	distance := func(tick, grid int) int {
+		offset := tick % grid
+		if grid-offset < offset {
+			return grid - offset
+		}
+		return offset
+	}
+	if distance(onsets[len(onsets)-1], bar) <= beat/4 {
+		return true
+	}
+	length := ph.length()
+	return length >= bar-beat/2 && distance(length, bar) <= beat/2
+}
+
+// median returns the middle of the values
+func median(values []int) int {
+	sorted := append([]int(nil), values...)
+	sort.Ints(sorted)
+	return sorted[len(sorted)/2]
+}
+
+// phraseEnded returns whether the host is done with the phrase. The
+// rest that ends a phrase is a couple of the usual intervals between
+// its keys, and less when the phrase comes to rest on a stable pitch,
+// holds its last key, or ends on a bar. It is never longer than the
+// BeatsOfSilence.
+func (p *Player) phraseEnded() bool {
+	logger := log.WithFields(log.Fields{
+		"function": "Player.phraseEnded",
+	})
+	rest := p.Tick - p.phrase.last()
+	if rest > p.BeatsOfSilence*p.TicksPerBeat {
+		return true
+	}
+	if len(p.phrase.onsets(p.TicksPerBeat)) < minPhraseNotes || rest < p.TicksPerBeat/4 {
+		return false
+	}
+	signs := 0
+	if p.phrase.cadence(p.TicksPerBeat) {
+		signs++
+	}
+	if p.phrase.longEnding(p.TicksPerBeat) {
+		signs++
+	}
+	if p.phrase.onBar(p.TicksPerBeat, p.barTicks()) {
+		signs++
+	}
+	needed := restIntervals * p.phrase.interval(p.TicksPerBeat) * (1 - endingBonus*float64(signs))
+	if float64(rest) < needed {
+		return false
+	}
+	logger.Debugf("Phrase ended after a rest of %d ticks, with %d signs", rest, signs)
+	return true
+}
+
+// barTicks returns the ticks of a bar of the music history
+func (p *Player) barTicks() int {
+	beats := p.MusicHistory.TimeSignature.Beats
+	if beats <= 0 {
+		beats = 4
+	}
+	return beats * p.TicksPerBeat
+}
+
+// answerLength returns the ticks that the answer to the phrase
+// lasts, in whole beats, or 0 to let the AI play its whole lick
+func (p *Player) answerLength() int {
+	if p.AnswerLength <= 0 {
+		return 0
+	}
+	beats := math.Ceil(float64(p.phrase.length()) * p.AnswerLength / float64(p.TicksPerBeat))
+	if beats < 1 {
+		beats = 1
+	}
+	return int(beats) * p.TicksPerBeat
+}
+
+// respond answers the phrase of the host once it ended. When there
+// is no phrase to answer, the AI improvises in the silence instead.
+func (p *Player) respond() {
+	logger := log.WithFields(log.Fields{
+		"function": "Player.respond",
+	})
+	if len(p.phrase.notes) == 0 || p.phrase.answered {
+		if p.Tick-p.lastNote > p.TicksPerBeat*p.BeatsOfSilence {
+			logger.Info("Silence exceeded, trying to improvise")
+			p.lastNote = p.Tick
+			p.learn(true, 0)
+		}
+		return
+	}
+	if !p.phraseEnded() {
+		return
+	}
+	length := p.answerLength()
+	// the phrase is answered once the AI is free
+	if !p.learn(true, length) {
+		return
+	}
+	p.phrase.answered = true
+	p.lastNote = p.Tick
+	logger.Infof("Answering a phrase of %d ticks with %d ticks", p.phrase.length(), length)
+}
@@ -0,0 +1,169 @@
+package player
+
+import (
+	"testing"
+	"time"
+
+	"github.com/schollz/pianoai/music"
+	"github.com/schollz/pianoai/piano"
+)
+
+// play adds keys to the phrase, each a pitch, a start and an end
+func (ph *phrase) play(keys ...[3]int) {
+	for _, key := range keys {
+		ph.add(key[0], key[1], true)
+		ph.add(key[0], key[2], false)
+	}
+}
+
+func TestPhraseEnded(t *testing.T) {
+	p := &Player{TicksPerBeat: 100, BeatsOfSilence: 2, MusicHistory: music.New()}
+
+	// an arpeggio that goes back to the tonic and holds it
+	p.phrase.play([3]int{60, 0, 40}, [3]int{64, 50, 90}, [3]int{67, 100, 140}, [3]int{60, 150, 250})
+	if !p.phrase.cadence(100) || !p.phrase.longEnding(100) || p.phrase.onBar(100, 400) {
+		t.Errorf("signs of the end of %+v are wrong", p.phrase.notes)
+	}
+	p.Tick = 290
+	if p.phraseEnded() {
+		t.Error("phrase ended too soon")
+	}
+	p.Tick = 300
+	if !p.phraseEnded() {
+		t.Error("phrase did not end at a cadence")
+	}
+
+	// a scale that stops halfway
+	p.phrase.reset()
+	p.phrase.play([3]int{60, 0, 40}, [3]int{62, 50, 90}, [3]int{64, 100, 140}, [3]int{65, 150, 190})
+	if p.phrase.cadence(100) || p.phrase.longEnding(100) {
+		t.Errorf("%+v ends on a cadence", p.phrase.notes)
+	}
+	p.Tick = 280
+	if p.phraseEnded() {
+		t.Error("phrase ended without a cadence")
+	}
+	p.Tick = 290
+	if !p.phraseEnded() {
+		t.Error("phrase did not end after a rest")
+	}
+
+	// a chord that lands on the next bar
+	p.phrase.reset()
+	p.phrase.play([3]int{67, 0, 90}, [3]int{65, 100, 390}, [3]int{64, 400, 440}, [3]int{60, 400, 440})
+	if !p.phrase.onBar(100, p.barTicks()) || !p.phrase.cadence(100) {
+		t.Errorf("%+v does not end on a bar", p.phrase.notes)
+	}
+
+	// a couple of keys are not a phrase, so the answer waits
+	p.phrase.reset()
+	p.phrase.play([3]int{60, 0, 40}, [3]int{62, 50, 90})
+	p.Tick = 290
+	if p.phraseEnded() {
+		t.Error("two keys ended a phrase")
+	}
+	p.Tick = 291
+	if !p.phraseEnded() {
+		t.Error("the answer waited longer than the beats of silence")
+	}
+}
+
+func TestAnswerLength(t *testing.T) {
+	p := &Player{TicksPerBeat: 100, AnswerLength: 1}
+	p.phrase.play([3]int{60, 1000, 1040}, [3]int{62, 1200, 1250})
+	if length := p.answerLength(); length != 300 {
+		t.Errorf("answer of a phrase of 250 ticks lasts %d ticks", length)
+	}
+	p.AnswerLength = 0.5
+	if length := p.answerLength(); length != 200 {
+		t.Errorf("half an answer lasts %d ticks", length)
+	}
+	p.AnswerLength = 0
+	if length := p.answerLength(); length != 0 {
+		t.Errorf("the whole lick lasts %d ticks", length)
+	}
+}
+
+func TestPlayerAnswersPhrase(t *testing.T) {
+	device := piano.NewLoopback()
+	p, cleanup := startTestPlayer(t, device, func(p *Player) {
+		p.ManualAI = false
+		// it does not improvise before the phrase
+		p.BeatsOfSilence = 8
+	})
+	defer cleanup()
+	events, cancel := p.Subscribe()
+	defer cancel()
+
+	// four keys in a little more than a beat
+	for _, pitch := range []int{72, 76, 79, 84} {
+		device.Play(piano.Event{Status: 0x90, Data1: pitch, Data2: 100})
+		time.Sleep(40 * time.Millisecond)
+		device.Play(piano.Event{Status: 0x80, Data1: pitch})
+		time.Sleep(40 * time.Millisecond)
+	}
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.Kind != LickGenerated {
+				continue
+			}
+			lick := event.Lick
+			if lick.Start%p.TicksPerBeat != 0 {
+				t.Errorf("answer starts at tick %d, which is not on a beat", lick.Start)
+			}
+			// the phrase lasts a little more than a beat
+			if lick.End-lick.Start > 2*p.TicksPerBeat {
+				t.Errorf("answer lasts %d ticks", lick.End-lick.Start)
+			}
+			return
+		case <-timeout:
+			t.Fatal("phrase was not answered")
+		}
+	}
+}
+
+func TestPlayerAnswersPhraseWhenFree(t *testing.T) {
+	device := piano.NewLoopback()
+	p, cleanup := startTestPlayer(t, device, func(p *Player) {
+		p.ManualAI = false
+		p.BeatsOfSilence = 8
+		// a learner that was cancelled is still busy
+		p.learnerBusy = true
+	})
+	defer cleanup()
+	events, cancel := p.Subscribe()
+	defer cancel()
+
+	for _, pitch := range []int{72, 76, 79, 84} {
+		device.Play(piano.Event{Status: 0x90, Data1: pitch, Data2: 100})
+		time.Sleep(40 * time.Millisecond)
+		device.Play(piano.Event{Status: 0x80, Data1: pitch})
+		time.Sleep(40 * time.Millisecond)
+	}
+	// the phrase ended, but the AI is busy
+	time.Sleep(300 * time.Millisecond)
+	if state := p.State(); state != Listening {
+		t.Fatalf("player is %s while the AI is busy", state)
+	}
+	p.request(func() {
+		p.learnerBusy = false
+	})
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.Kind != LickGenerated {
+				continue
+			}
+			// an answer, not an improvisation in the silence
+			if lick := event.Lick; lick.End-lick.Start > 2*p.TicksPerBeat {
+				t.Errorf("answer lasts %d ticks", lick.End-lick.Start)
+			}
+			return
+		case <-timeout:
+			t.Fatal("phrase was not answered once the AI was free")
+		}
+	}
+}
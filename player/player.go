@@ -2,8 +2,13 @@ package player
 
 import (
 	"fmt"
+	"math"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/schollz/pianoai/ai2"
@@ -25,9 +30,9 @@ func init() {
 }
 
 // Player is the main structure which facilitates the Piano, and the AI.
-// The Player spawns threads for listening to events on the Piano, and also
-// spawns threads for playing notes on the piano. It also spawns threads
-// for doing the machine learning and using the results.
+// The Player spawns threads for listening to events on the Piano, for
+// playing notes on the piano and for doing the machine learning, but
+// only the thread of Start changes the player, see State.
 type Player struct {
 	// BPM is the beats per minute
 	BPM int
@@ -43,11 +48,22 @@ type Player struct {
 	// MusicHistory is a map of all the previous notes played
 	MusicHistory     *music.Music
 	MusicHistoryFile string
+	// training is the music of LoadMIDI, which the AI learns from
+	// before the history, but which is never recorded or saved
+	training *music.Music
 
 	// AI stores the AI being used
 	AI *ai2.AI
-	// BeatsOfSilence waits this number of beats before asking
-	// the AI for an improvisation
+	// Engines are the AIs to choose from with ActionEngine, the
+	// first one improvises unless there are none, then the AI does
+	Engines []Engine
+	// engine is the position of the engine that improvises
+	engine int
+	// lastLick is the last improvisation, for ActionReplay
+	lastLick *music.Music
+	// BeatsOfSilence waits this number of beats before asking the AI
+	// for an improvisation, or at most this number of beats before
+	// answering a phrase of the host (see respond)
 	BeatsOfSilence int
 	// lastNote is the beat of the last note played
 	lastNote int
@@ -59,24 +75,133 @@ type Player struct {
 
 	// Listening frequency (to determine tick size)
 	ListeningRateHertz int
+	// Clock moves the player forward, it ticks at the
+	// listening frequency unless it is changed before Start
+	Clock Clock
+	// clockStarted is set once a MIDI start was sent for the
+	// pulses of the clock, until the MIDI stop is sent
+	clockStarted bool
 	// Number of ticks per beat
 	TicksPerBeat int
-	// 1/Quantize = shortest possible note
+	// Quantize snaps the notes that are played to 1/Quantize
+	// of a beat, or keeps them where they are when it is 0
 	Quantize int
 
 	// flag to allow only manually activation
 	ManualAI bool
 
+	// Controls binds the actions to the keyboard
+	Controls ControlMap
+	// controls keeps track of the keyboard for the Controls
+	controls controls
+	// phrases are the number of notes in the music history
+	// when each phrase of the host started, for ActionUndo
+	phrases []int
+	// lastHostNote is the tick of the last key of the host
+	lastHostNote int
+
+	// EstimateTempo tells the tempo that the host seems to play at,
+	// see TempoEstimated, and stretches the improvisations to the
+	// beat of the player when the host plays at another tempo
+	EstimateTempo bool
+	// FollowTempo changes the tempo to the tempo of the host, and
+	// stretches the improvisations like EstimateTempo
+	FollowTempo bool
+	// onsets are the ticks of the last keys pressed by the host
+	onsets []int
+	// lastEstimate is the tick of the last estimate of the tempo
+	lastEstimate int
+	// proposedBPM is the last tempo that was estimated
+	proposedBPM int
+	// taps are the times of the last taps, see ActionTap
+	taps []time.Time
+
+	// AnswerLength is how long the answer of the AI to a phrase
+	// of the host is, relative to the phrase. The AI plays its
+	// whole lick when it is 0.
+	AnswerLength float64
+	// phrase is the phrase of the host that is played, see respond
+	phrase phrase
+
 	// UseHostVelocity changes emitted notes to follow the velocity of the host
 	UseHostVelocity bool
 
+	// AIVoice plays the improvisations of the AI
+	AIVoice piano.Voice
+	// PlaybackVoice plays back the history
+	PlaybackVoice piano.Voice
+	// ClickVoice plays the click, on the percussion channel by default
+	ClickVoice piano.Voice
+	// Click plays a click on every beat
+	Click bool
+
 	LastHostPress int
-	IsImprovising bool
 	lastVelocity  int
+
+	// state is what the player is doing
+	state State
+	// resume is the state to go back to after being paused
+	resume State
+	// status is a copy of the state and the tick for other threads
+	status struct {
+		state State
+		tick  int
+		sync.Mutex
+	}
+
+	// done stops the metronome
+	done chan bool
+	// connections tells the metronome when the keyboard is
+	// plugged in or unplugged, and connection is how it is now
+	connections chan bool
+	connection  struct {
+		connected bool
+		// plugs counts how many times the keyboard was plugged in
+		plugs int
+		sync.Mutex
+	}
+	// plugs is the count of the connection the player is at
+	plugs int
+	// notes are played by the host
+	notes chan music.Note
+	// commands are run by the thread of Start, see request
+	commands chan func()
+	// learned receives the results of the AI
+	learned chan learning
+	// learningID is the id of the results that are wanted
+	learningID int
+	// learnerBusy is set while the AI is learning, even when
+	// its result is not wanted anymore
+	learnerBusy bool
+	// outputs are the writes to the piano, in the order they are played
+	outputs chan func()
+	// closing stops the output
+	closing       chan bool
+	outputStopped chan bool
+	// timeline gives the ticks of the events that are played
+	timeline timeline
+	// subscribers receive the events of the player, see Subscribe
+	subscribers struct {
+		channels map[chan Event]bool
+		closed   bool
+		sync.Mutex
+	}
 }
 
-// New initializes the parameters and connects up the piano
-func New(bpm, listenHertz int, debug bool) (p *Player, err error) {
+// New initializes the parameters and connects up the piano. The music
+// history is loaded from and saved to the history file, in the format
+// chosen by its extension (see music.Save).
+func New(bpm, listenHertz int, historyFile string, debug bool) (p *Player, err error) {
+	device, err := piano.Watch("", "", "")
+	if err != nil {
+		return
+	}
+	return NewWithDevice(bpm, listenHertz, historyFile, debug, device)
+}
+
+// NewWithDevice initializes the player like New, but connects
+// to the given device instead of the portmidi keyboard.
+func NewWithDevice(bpm, listenHertz int, historyFile string, debug bool, device piano.Device) (p *Player, err error) {
 	p = new(Player)
 	logger := log.WithFields(log.Fields{
 		"function": "Player.Init",
@@ -88,33 +213,86 @@ func New(bpm, listenHertz int, debug bool) (p *Player, err error) {
 	p.Tick = 0
 	p.Key = "C"
 	p.Quantize = 64
+	p.Controls = DefaultControls()
+	p.AnswerLength = 1
+	p.ClickVoice = piano.Voice{Channel: 9}
+	p.done = make(chan bool, 1)
+	p.connections = make(chan bool, 1)
+	p.notes = make(chan music.Note, 1024)
+	p.commands = make(chan func(), 16)
+	p.learned = make(chan learning, 1)
+	// the player waits while the keyboard is unplugged
+	if watcher, ok := device.(*piano.Watcher); ok {
+		p.transition(Paused)
+		p.resume = Listening
+		watcher.OnConnect = func(connected bool) {
+			p.connection.Lock()
+			p.connection.connected = connected
+			if connected {
+				p.connection.plugs++
+			}
+			p.connection.Unlock()
+			// the player reads the latest connection, so
+			// a signal that is already waiting is enough
+			select {
+			case p.connections <- true:
+			default:
+			}
+		}
+	}
 
 	logger.Debug("Loading piano")
-	p.Piano, err = piano.New()
+	p.Piano, err = piano.NewWithDevice(device)
 	if err != nil {
 		return
 	}
+	p.outputs = make(chan func(), 1024)
+	p.closing = make(chan bool)
+	p.outputStopped = make(chan bool)
+	go p.output()
 
 	logger.Debug("Loading music")
 	p.MusicFuture = music.New()
+	p.training = music.New()
 	var errOpening error
-	p.MusicHistoryFile = "music_history.json"
+	p.ListeningRateHertz = listenHertz
+	p.TicksPerBeat = int(float64(p.ListeningRateHertz) / (float64(p.BPM) / 60))
+	p.Clock = NewInternalClock(p.ListeningRateHertz)
+	p.MusicHistoryFile = historyFile
 	p.MusicHistory, errOpening = music.Open(p.MusicHistoryFile)
 	if errOpening != nil {
 		logger.Warn(errOpening.Error())
 		p.MusicHistory = music.New()
 	} else {
 		logger.Info("Loaded previous music history")
+		if p.MusicHistory.TicksPerBeat == 0 {
+			logger.Warnf("Music history has no recorded tempo, assuming %d ticks / beat", p.TicksPerBeat)
+		} else if p.MusicHistory.TicksPerBeat != p.TicksPerBeat {
+			logger.Warnf("Music history was recorded at %d bpm with %d ticks / beat, rescaling to %d ticks / beat", p.MusicHistory.BPM, p.MusicHistory.TicksPerBeat, p.TicksPerBeat)
+			p.MusicHistory = p.MusicHistory.Rescale(p.TicksPerBeat)
+		}
+	}
+	p.MusicHistory.BPM = p.BPM
+	p.MusicHistory.TicksPerBeat = p.TicksPerBeat
+	p.MusicHistory.Key = p.Key
+	// a keyboard that is watched has no name until it is connected
+	p.MusicHistory.Device = p.Piano.InputName()
+	// every note is journaled so nothing is lost in a crash,
+	// and recovered notes are saved right away
+	err = p.MusicHistory.StartJournal(p.MusicHistoryFile)
+	if err != nil {
+		return
+	}
+	err = p.MusicHistory.Compact()
+	if err != nil {
+		return
 	}
 
 	logger.Debug("Loading AI")
-	p.ListeningRateHertz = listenHertz
 	p.BeatsOfSilence = 2
 	p.HighPassFilter = 65
 	p.lastNote = 0
 
-	p.TicksPerBeat = int(float64(p.ListeningRateHertz) / (float64(p.BPM) / 60))
-
 	p.AI = ai2.New(p.TicksPerBeat)
 	p.AI.HighPassFilter = p.HighPassFilter
 
@@ -127,196 +305,623 @@ func (p *Player) Close() (err error) {
 		"function": "Player.Close",
 	})
 	logger.Debug("Closing piano...")
+	select {
+	case <-p.closing:
+	default:
+		close(p.closing)
+	}
+	<-p.outputStopped
 	err = p.Piano.Close()
 	if err != nil {
 		logger.Error(err.Error())
+		p.publishError(err)
 	}
+	logger.Debug("Closing music history journal...")
+	err = p.MusicHistory.StopJournal()
+	if err != nil {
+		logger.Error(err.Error())
+		p.publishError(err)
+	}
+	p.unsubscribeAll()
 	return
 }
 
 // Start initializes the metronome which keeps track of beats
-// Each beat will start new threads to Emit new chords, and/or
-// generate new Improvisation
+// Each tick will Emit new chords, and/or ask the AI for an
+// Improvisation. It runs the state machine of the player, so
+// everything that changes the player happens on its thread.
 func (p *Player) Start() {
 	logger := log.WithFields(log.Fields{
 		"function": "Player.Start",
 	})
 
 	// Exit on Ctl+C
-	doneChan := make(chan bool)
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
-	go func() {
-		for sig := range c {
-			logger.Debugf("%+v", sig)
-			// sig is a ^C, handle it
-			p.Close()
-			doneChan <- true
-		}
-	}()
+	defer signal.Stop(c)
 
 	// start listening
 	go p.Listen()
+	if p.state != Paused {
+		p.setupVoices()
+	}
 
-	p.Tick = 0
-	tickTime := 1000 * time.Duration(1000000/p.ListeningRateHertz)
-	tickChan := time.NewTicker(tickTime).C
-	logger.Infof("BPM:  %d, tick size: %s (%d ticks / beat)", p.BPM, tickTime.String(), p.TicksPerBeat)
+	p.setTick(0)
+	tickChan := p.Clock.Start(p.TicksPerBeat)
+	defer p.Clock.Stop()
+	defer p.stopClock()
+	p.timeline.reset(p.Tick, time.Now(), 0)
+	logger.Infof("BPM:  %d, %d ticks / beat, %T", p.BPM, p.TicksPerBeat, p.Clock)
 	for {
 		select {
-		case <-tickChan:
-			// if p.Tick == math.Trunc(p.Tick) {
-			// 	logger.Debugf("beat %2.0f", p.Tick)
-			// }
-			p.Tick += 1
-			go p.Emit(p.Tick)
-
-			if !p.ManualAI {
-				if p.Tick-p.lastNote > (p.TicksPerBeat*p.BeatsOfSilence) && p.KeysCurrentlyPressed == 0 && !p.AI.IsLearning {
-					logger.Info("Silence exceeded, trying to improvise")
-					p.lastNote = p.Tick
-					go p.Improvisation()
+		case sig := <-c:
+			logger.Debugf("%+v", sig)
+			// sig is a ^C, handle it
+			p.silence()
+			fmt.Println("Done")
+			return
+
+		case <-p.connections:
+			p.reconnect()
+
+		case position := <-tickChan:
+			// the first keys of a combination that was not completed
+			// are played after all
+			for _, note := range p.controls.expire(time.Now()) {
+				p.hear(note)
+			}
+			if position.BPM > 0 && position.BPM != p.BPM {
+				p.tempoChanged(position.BPM)
+			}
+			if position.Jump {
+				if position.Tick != p.Tick {
+					p.relocate(position.Tick)
 				}
+				continue
 			}
+			if p.state == Paused {
+				continue
+			}
+			// an external clock can move several ticks at once
+			from := p.Tick + 1
+			p.setTick(p.Tick + position.Ticks)
+			// the clock may be read late, so the tick is
+			// marked at the time the clock reached it
+			at := position.At
+			if at.IsZero() {
+				at = time.Now()
+			}
+			p.timeline.advance(p.Tick, at)
+			p.sendClock(position.Pulses)
+			p.Emit(from, p.Tick+1)
+
+			switch p.state {
+			case Improvising, Playback:
+				if !p.MusicFuture.HasFuture(p.Tick) {
+					p.transition(Listening)
+				}
+			case Listening:
+				if !p.ManualAI && p.KeysCurrentlyPressed == 0 {
+					p.respond()
+				}
+			}
+
+		case note := <-p.notes:
+			p.handle(note)
 
-			// if math.Mod(float64(p.Tick), 64) == 0 {
-			// 	logger.WithFields(log.Fields{
-			// 		"Beat":     p.Tick,
-			// 		"LastNote": p.lastNote,
-			// 		"KeysDown": p.KeysCurrentlyPressed,
-			// 	}).Debug("metronome")
-			// }
+		case command := <-p.commands:
+			command()
 
-		case <-doneChan:
+		case result := <-p.learned:
+			p.finishLearning(result)
+
+		case <-p.done:
 			fmt.Println("Done")
 			return
 		}
 	}
 }
 
-func (p *Player) Teach() (err error) {
+// setTick moves the player to the tick
+func (p *Player) setTick(tick int) {
+	p.Tick = tick
+	p.status.Lock()
+	p.status.tick = tick
+	p.status.Unlock()
+}
+
+// Stop ends the metronome, which returns from Start
+func (p *Player) Stop() {
+	select {
+	case p.done <- true:
+	default:
+	}
+}
+
+// output writes to the piano, one write after the other, until the
+// player is closed. It is the only thread that writes to the piano,
+// so everything is played in the order that it is scheduled.
+func (p *Player) output() {
+	defer close(p.outputStopped)
+	for {
+		select {
+		case write := <-p.outputs:
+			write()
+		case <-p.closing:
+			// finish what was scheduled, like turning off notes
+			for {
+				select {
+				case write := <-p.outputs:
+					write()
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// schedule queues a write to the piano, see output
+func (p *Player) schedule(write func()) {
+	select {
+	case p.outputs <- write:
+	case <-p.closing:
+	}
+}
+
+// setupVoices selects the instruments of the voices on the keyboard
+func (p *Player) setupVoices() {
+	p.schedule(func() {
+		err := p.Piano.SetupVoices(p.AIVoice, p.PlaybackVoice, p.ClickVoice)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"function": "Player.setupVoices",
+			}).Error(err.Error())
+			p.publishError(err)
+		}
+	})
+}
+
+// clicks returns the click at the start of every beat from the tick
+// from up to the tick to, on the side stick of the General MIDI drums
+func (p *Player) clicks(from, to int) (notes []music.Note) {
+	for tick := from; tick < to; tick++ {
+		switch tick % p.TicksPerBeat {
+		case 0:
+			notes = append(notes, music.Note{On: true, Pitch: 37, Velocity: 80, Beat: tick, Channel: p.ClickVoice.Channel})
+		case p.TicksPerBeat / 4:
+			notes = append(notes, music.Note{On: false, Pitch: 37, Velocity: 0, Beat: tick, Channel: p.ClickVoice.Channel})
+		}
+	}
+	return
+}
+
+// LoadMIDI adds the notes of a Standard MIDI File to the music that
+// the AI learns from. They are not part of the music history, so they
+// are not recorded, saved or exported, and only last until Close.
+func (p *Player) LoadMIDI(filename string) (err error) {
 	logger := log.WithFields(log.Fields{
-		"function": "Player.Teach",
+		"function": "Player.LoadMIDI",
 	})
-	logger.Info("Sending history to AI")
-	err = p.AI.Learn(p.MusicHistory)
+	m, err := music.OpenMIDI(filename, p.BPM, p.TicksPerBeat)
 	if err != nil {
-		logger.Warn(err.Error())
 		return
 	}
+	offset := 0
+	if last, ok := p.training.Last(); ok {
+		offset = last + p.TicksPerBeat
+	}
+	notes := m.GetAll()
+	for _, note := range notes {
+		note.Beat += offset
+		p.training.AddNote(note)
+	}
+	logger.Infof("Loaded %d notes from %s", len(notes), filename)
 	return
 }
 
-// Improvisation generates an improvisation from the AI
-// and loads into the next beats to be playing
+// Teach asks the AI to learn from the music history
+func (p *Player) Teach() {
+	p.request(func() {
+		p.learn(false, 0)
+	})
+}
+
+// Improvisation asks the AI to learn from the music history,
+// and then to improvise in the next beats
 func (p *Player) Improvisation() {
+	p.request(func() {
+		p.learn(true, 0)
+	})
+}
+
+// learn starts the AI on its own thread, and improvises when
+// the lick is wanted. An answer to a phrase of the host is cut
+// to its length in ticks, unless it is 0. The AI only starts
+// while listening, and when the AI is not busy with an earlier
+// request that is not wanted anymore. It returns whether it started.
+func (p *Player) learn(lick bool, answer int) (started bool) {
+	logger := log.WithFields(log.Fields{
+		"function": "Player.learn",
+	})
+	if p.state != Listening || p.learnerBusy {
+		logger.Debugf("Not learning while %s (busy: %v)", p.state, p.learnerBusy)
+		return false
+	}
+	p.learningID++
+	p.learnerBusy = true
+	p.transition(Learning)
+	go func(id int, engine Engine, onsets []int) {
+		result := learning{id: id, answer: answer}
+		start := time.Now()
+		logger.Infof("Sending history to %T", engine)
+		result.lick, result.err = improvise(engine, p.learningMusic(), lick)
+		result.scale = 1
+		if result.lick != nil && onsets != nil {
+			// the lick has the beat of the host, who
+			// may not play at the tempo of the player
+			result.lick, result.scale = scaleLick(result.lick, onsets, p.TicksPerBeat)
+		}
+		result.took = time.Since(start)
+		select {
+		case p.learned <- result:
+		case <-p.closing:
+		}
+	}(p.learningID, p.currentEngine(), p.tempoOnsets())
+	return true
+}
+
+// learningMusic returns the music that the AI learns from, which
+// is the training music followed by the music history
+func (p *Player) learningMusic() *music.Music {
+	last, ok := p.training.Last()
+	if !ok {
+		return p.MusicHistory
+	}
+	return p.MusicHistory.Shift(last + p.TicksPerBeat).Merge(p.training)
+}
+
+// finishLearning loads the improvisation of the AI into the next
+// beats to be played, unless it is not wanted anymore
+func (p *Player) finishLearning(result learning) {
 	logger := log.WithFields(log.Fields{
-		"function": "Player.Improvisation",
+		"function": "Player.finishLearning",
 	})
-	if p.MusicFuture.HasFuture(p.Tick) || p.IsImprovising {
-		logger.Debug("Improvising is already in progress")
+	p.learnerBusy = false
+	if result.id != p.learningID {
+		logger.Debug("Dropping stale improvisation")
 		return
 	}
-	p.IsImprovising = true
-	err := p.Teach()
-	if err != nil {
+	if result.err != nil {
+		logger.Warn(result.err.Error())
+		p.publishError(result.err)
+		p.settle(Listening)
 		return
 	}
-	logger.Info("Getting improvisation")
-	notes, err := p.AI.Lick(p.Tick)
-	if err != nil {
-		logger.Error(err.Error())
+	if result.lick == nil {
+		p.settle(Listening)
+		return
 	}
-	newNotes := notes.GetAll()
-	for _, note := range newNotes {
+	start := p.Tick + 1
+	if result.answer > 0 {
+		// the answer fits the phrase, and starts on a beat
+		first, _ := result.lick.First()
+		result.lick = result.lick.Slice(first, first+result.answer)
+		start = (p.Tick/p.TicksPerBeat + 1) * p.TicksPerBeat
+	}
+	p.lastLick = result.lick
+	lick := p.playLick(result.lick, start)
+	logger.Infof("Added %d notes from AI", lick.Len())
+	if result.scale != 1 {
+		logger.Infof("Stretched the lick by %.2f to the beat", result.scale)
+	}
+	generated := &Lick{Music: lick, Notes: lick.Len(), Took: result.took, Scale: result.scale}
+	generated.Start, _ = lick.First()
+	generated.End, _ = lick.Last()
+	p.publish(Event{Kind: LickGenerated, Tick: p.Tick, Lick: generated})
+	p.settle(Improvising)
+}
+
+// playLick adds the improvisation to the beats to be played from
+// the tick start on, and returns its notes as they will be played
+func (p *Player) playLick(lick *music.Music, start int) (played *music.Music) {
+	played = music.New()
+	first, _ := lick.First()
+	for _, note := range lick.Shift(start - first).GetAll() {
+		note.Channel = p.AIVoice.Channel
+		played.AddNote(note)
 		p.MusicFuture.AddNote(note)
 	}
-	logger.Infof("Added %d notes from AI", len(newNotes))
-	p.IsImprovising = false
+	return
 }
 
-// Emit will play/stop notes depending on the current beat.
-// This should be run in a separate thread.
-func (p *Player) Emit(beat int) {
-	hasNotes, notes := p.MusicFuture.Get(beat)
-	if hasNotes {
+// Emit will play/stop the notes from the tick from up to, but not
+// including, the tick to, in order, together with the clicks
+func (p *Player) Emit(from, to int) {
+	notes := p.MusicFuture.Range(from, to)
+	if len(notes) > 0 {
 		if p.Tick-p.LastHostPress > p.BeatsOfSilence*p.TicksPerBeat && p.KeysCurrentlyPressed == 0 {
 			if p.UseHostVelocity && p.lastVelocity > 0 {
 				for i := range notes {
 					notes[i].Velocity = p.lastVelocity
 				}
 			}
-			go p.Piano.PlayNotes(notes, p.BPM)
+		} else {
+			// the host is playing, but notes that are already
+			// on still have to be turned off, and the pedals
+			// and bends of the AI let go
+			offs := notes[:0]
+			for _, note := range notes {
+				if note.IsRelease() {
+					offs = append(offs, note)
+				}
+			}
+			notes = offs
 		}
 		p.lastNote = p.Tick
 	}
+	played := append([]music.Note(nil), notes...)
+	if p.Click {
+		notes = append(notes, p.clicks(from, to)...)
+		sort.Stable(music.Notes(notes))
+	}
+	if len(notes) == 0 {
+		return
+	}
+	bpm := p.BPM
+	// the notes are stamped with the time of their tick, so that
+	// waiting for the writes before them does not make them late
+	at := p.timeline.timeOf(p.Tick)
+	p.schedule(func() {
+		err := p.Piano.PlayNotesAt(notes, bpm, at)
+		if err != nil {
+			p.publishError(err)
+			return
+		}
+		for _, note := range played {
+			p.publish(Event{Kind: AINote, Tick: note.Beat, Note: note})
+		}
+	})
+}
+
+// sendClock sends the pulses of MIDI clock at the current tick, with
+// a MIDI start before the first ones. They go out with the notes, at
+// the time of the tick, so the notes are not late behind them.
+func (p *Player) sendClock(pulses int) {
+	if pulses == 0 {
+		return
+	}
+	var events []piano.Event
+	if !p.clockStarted {
+		events = append(events, piano.Event{Status: 0xFA})
+		p.clockStarted = true
+	}
+	for i := 0; i < pulses; i++ {
+		events = append(events, piano.Event{Status: 0xF8})
+	}
+	p.writeClock(events, p.timeline.timeOf(p.Tick))
+}
+
+// stopClock sends a MIDI stop after the pulses of MIDI clock
+func (p *Player) stopClock() {
+	if !p.clockStarted {
+		return
+	}
+	p.clockStarted = false
+	p.writeClock([]piano.Event{{Status: 0xFC}}, time.Time{})
+}
+
+// writeClock queues the clock messages, see schedule
+func (p *Player) writeClock(events []piano.Event, at time.Time) {
+	p.schedule(func() {
+		err := p.Piano.WriteEventsAt(at, events...)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"function": "Player.writeClock",
+			}).Debug(err.Error())
+		}
+	})
+}
+
+// quantize snaps the tick to the grid of 1/Quantize of a beat
+func (p *Player) quantize(tick int) int {
+	if p.Quantize <= 0 {
+		return tick
+	}
+	grid := float64(p.TicksPerBeat) / float64(p.Quantize)
+	if grid <= 1 {
+		return tick
+	}
+	return int(math.Floor(float64(tick)/grid+0.5) * grid)
+}
+
+// Panic drops the notes that are waiting to be played, and
+// turns off every note on the piano
+func (p *Player) Panic() {
+	p.request(p.silence)
+}
+
+// silence drops the notes that are waiting to be played and any
+// improvisation that is being learned, turns off every note on
+// the piano and goes back to listening
+func (p *Player) silence() {
+	p.learningID++
+	p.MusicFuture.Clear()
+	p.settle(Listening)
+	p.schedule(func() {
+		err := p.Piano.Panic()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"function": "Player.silence",
+			}).Error(err.Error())
+			p.publishError(err)
+		}
+	})
 }
 
 // Listen tells the player to listen to events from the
 // piano MIDI connection. This is meant to be run in a
 // separate thread.
 func (p *Player) Listen() {
+	ch := p.Piano.Listen()
+	for event := range ch {
+		// system messages go to clocks that follow them
+		if event.Status >= 0xF0 {
+			if receiver, ok := p.Clock.(interface {
+				Receive(event piano.Event)
+			}); ok {
+				receiver.Receive(event)
+			}
+			continue
+		}
+		tickOfNote := p.quantize(p.timeline.tickOf(event.Timestamp, time.Now()))
+		// only keep notes, control changes (like the pedals) and pitch bends
+		note, ok := music.FromMIDI(event.Status, event.Data1, event.Data2, tickOfNote)
+		if !ok {
+			continue
+		}
+		select {
+		case p.notes <- note:
+		case <-p.closing:
+			return
+		}
+	}
+}
+
+// reconnect pauses the player while the keyboard is unplugged,
+// and resumes it once the keyboard is plugged in again
+func (p *Player) reconnect() {
 	logger := log.WithFields(log.Fields{
-		"function": "Player.Listen",
+		"function": "Player.reconnect",
 	})
+	p.connection.Lock()
+	connected, plugs := p.connection.connected, p.connection.plugs
+	p.connection.Unlock()
+	// the keyboard may have been unplugged and plugged in
+	// again before the player heard of it
+	replugged := plugs != p.plugs
+	p.plugs = plugs
+	if p.state != Paused && (!connected || replugged) {
+		logger.Warn("Keyboard disconnected, pausing")
+		p.KeysCurrentlyPressed = 0
+		p.resume = p.state
+		p.transition(Paused)
+	}
+	if connected && p.state == Paused {
+		logger.Info("Keyboard connected, resuming")
+		p.MusicHistory.Lock()
+		p.MusicHistory.Device = p.Piano.InputName()
+		p.MusicHistory.Unlock()
+		p.timeline.reset(p.Tick, time.Now(), 0)
+		p.setupVoices()
+		p.transition(p.resume)
+	}
+}
 
-	ch := p.Piano.InputStream.Listen()
-	prevTick := p.Tick
-	for {
-		event := <-ch
-		tickOfNote := p.Tick
-		// only allow up to 64th notes
-		if tickOfNote-prevTick < p.TicksPerBeat/p.Quantize {
-			tickOfNote = prevTick
-		}
-		note := music.Note{
-			On:       event.Data2 > 0,
-			Pitch:    int(event.Data1),
-			Velocity: int(event.Data2),
-			Beat:     tickOfNote,
-		}
-		prevTick = tickOfNote
+// handle records a note played by the host, or does what the
+// keys at the ends of the keyboard ask for
+func (p *Player) handle(note music.Note) {
+	actions, played := p.controls.match(p.Controls, note)
+	for _, note := range played {
+		p.hear(note)
+	}
+	for _, action := range actions {
+		p.do(action)
+	}
+}
 
-		if note.Pitch == 21 {
-			if !note.On {
-				continue
-			}
-			p.MusicHistory.Save(p.MusicHistoryFile)
-			logger.Infof("Saved %s.json", p.MusicHistoryFile)
-		} else if note.Pitch == 22 {
-			if !note.On {
-				continue
-			}
-			logger.Info("Playing back history")
-			for _, note := range p.MusicHistory.GetAll() {
-				logger.Infof("Adding %+v to future", note)
-				p.MusicFuture.AddNote(note)
-			}
-			p.Tick = 0
-		} else if note.Pitch == 107 {
-			if !note.On {
-				continue
-			}
-			p.Teach()
-		} else if note.Pitch == 108 {
-			if !note.On {
-				continue
-			}
-			p.Improvisation()
-		} else {
-			if !note.On && note.Pitch > p.HighPassFilter {
-				p.lastNote = p.Tick
-				p.KeysCurrentlyPressed--
-			}
-			if note.On && note.Pitch > p.HighPassFilter {
-				p.LastHostPress = p.Tick
-				p.KeysCurrentlyPressed++
-			}
-			if note.On && p.UseHostVelocity {
-				p.lastVelocity = note.Velocity
-			}
-			logger.Infof("Adding %+v", note)
-			go p.MusicHistory.AddNote(note)
-		}
+// hear records a note that the host played
+func (p *Player) hear(note music.Note) {
+	logger := log.WithFields(log.Fields{
+		"function": "Player.hear",
+	})
+	if !note.IsNote() {
+		// the pedals send many of them, so they are only debugged
+		logger.Debugf("Adding %+v", note)
+		p.record(note)
+		return
+	}
+	if note.On && (len(p.phrases) == 0 || p.phrase.answered || p.Tick-p.lastHostNote > p.BeatsOfSilence*p.TicksPerBeat) {
+		p.phrases = append(p.phrases, p.MusicHistory.Len())
+		p.phrase.reset()
+	}
+	p.lastHostNote = p.Tick
+	if !note.On && note.Pitch > p.HighPassFilter {
+		p.lastNote = p.Tick
+		p.KeysCurrentlyPressed--
+	}
+	if note.On && note.Pitch > p.HighPassFilter {
+		p.LastHostPress = p.Tick
+		p.KeysCurrentlyPressed++
+	}
+	if note.Pitch > p.HighPassFilter {
+		p.phrase.add(note.Pitch, note.Beat, note.On)
+	}
+	if note.On && p.UseHostVelocity {
+		p.lastVelocity = note.Velocity
+	}
+	if note.On {
+		p.onset(note.Beat)
+	}
+	logger.Infof("Adding %+v", note)
+	p.record(note)
+}
+
+// record adds a note to the music history
+func (p *Player) record(note music.Note) {
+	err := p.MusicHistory.AddNote(note)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"function": "Player.record",
+		}).Error(err.Error())
+		p.publishError(err)
+		return
+	}
+	p.publish(Event{Kind: HostNote, Tick: note.Beat, Note: note})
+}
+
+// save writes the music history, and a MIDI file next to it
+func (p *Player) save(bpm int) {
+	logger := log.WithFields(log.Fields{
+		"function": "Player.save",
+	})
+	err := p.MusicHistory.Compact()
+	if err != nil {
+		logger.Error(err.Error())
+		p.publishError(err)
+	} else {
+		logger.Infof("Saved %s", p.MusicHistoryFile)
+		p.publish(Event{Kind: HistorySaved, Tick: p.CurrentTick(), Filename: p.MusicHistoryFile})
+	}
+	midiFile := strings.TrimSuffix(p.MusicHistoryFile, ".gz")
+	midiFile = strings.TrimSuffix(midiFile, filepath.Ext(midiFile)) + ".mid"
+	err = p.MusicHistory.SaveMIDI(midiFile, bpm, p.TicksPerBeat)
+	if err != nil {
+		logger.Error(err.Error())
+		p.publishError(err)
+	} else {
+		logger.Infof("Saved %s", midiFile)
+		p.publish(Event{Kind: HistorySaved, Tick: p.CurrentTick(), Filename: midiFile})
+	}
+}
+
+// playback plays the music history from the next tick on
+func (p *Player) playback() {
+	logger := log.WithFields(log.Fields{
+		"function": "Player.playback",
+	})
+	if p.state != Listening {
+		logger.Debugf("Not playing back while %s", p.state)
+		return
+	}
+	first, ok := p.MusicHistory.First()
+	if !ok {
+		return
+	}
+	logger.Info("Playing back history")
+	for _, note := range p.MusicHistory.Shift(p.Tick + 1 - first).GetAll() {
+		note.Channel = p.PlaybackVoice.Channel
+		p.MusicFuture.AddNote(note)
 	}
+	p.transition(Playback)
 }
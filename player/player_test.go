@@ -0,0 +1,507 @@
+package player
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/schollz/pianoai/music"
+	"github.com/schollz/pianoai/piano"
+)
+
+// newTestPlayer starts a player on a loopback device, with a copy
+// of the jam session as its history
+func newTestPlayer(t *testing.T) (p *Player, device *piano.Loopback, cleanup func()) {
+	device = piano.NewLoopback()
+	p, cleanup = startTestPlayer(t, device, nil)
+	return
+}
+
+// startTestPlayer starts a player on the device, with a copy of the
+// jam session as its history. The AI is activated manually, unless
+// the player is configured otherwise before it starts.
+func startTestPlayer(t *testing.T, device piano.Device, configure func(p *Player)) (p *Player, cleanup func()) {
+	dir, err := ioutil.TempDir("", "player")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile("../testing/em_jam.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	historyFile := filepath.Join(dir, "history.json")
+	if err = ioutil.WriteFile(historyFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err = NewWithDevice(240, 400, historyFile, false, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.ManualAI = true
+	if configure != nil {
+		configure(p)
+	}
+	done := make(chan bool)
+	go func() {
+		p.Start()
+		close(done)
+	}()
+	cleanup = func() {
+		p.Stop()
+		<-done
+		p.Close()
+		os.RemoveAll(dir)
+	}
+	return
+}
+
+// waitFor polls the condition until it is true or a few seconds have passed
+func waitFor(condition func() bool) bool {
+	for i := 0; i < 500; i++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestPlayerRecords(t *testing.T) {
+	p, device, cleanup := newTestPlayer(t)
+	defer cleanup()
+
+	before := p.MusicHistory.Len()
+	device.Play(
+		piano.Event{Status: 0x90, Data1: 72, Data2: 100},
+		piano.Event{Status: 0x80, Data1: 72, Data2: 0},
+		piano.Event{Status: 0xB0, Data1: 64, Data2: 127},
+	)
+	if !waitFor(func() bool { return p.MusicHistory.Len() == before+3 }) {
+		t.Fatalf("recorded %d notes, expected 3", p.MusicHistory.Len()-before)
+	}
+	ons, offs, pedals := 0, 0, 0
+	for _, note := range p.MusicHistory.GetAll() {
+		switch {
+		case note.Kind == music.ControlEvent && note.Pitch == music.SustainPedal:
+			pedals++
+		case note.Pitch == 72 && note.On:
+			ons++
+		case note.Pitch == 72:
+			offs++
+		}
+	}
+	if ons != 1 || offs != 1 || pedals != 1 {
+		t.Errorf("recorded %d ons, %d offs and %d pedals", ons, offs, pedals)
+	}
+}
+
+func TestLoadMIDI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "player")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	scale := music.New()
+	for i, pitch := range []int{60, 62, 64, 65} {
+		scale.AddNote(music.Note{On: true, Pitch: pitch, Velocity: 80, Beat: i * 100})
+		scale.AddNote(music.Note{On: false, Pitch: pitch, Beat: i*100 + 90})
+	}
+	midiFile := filepath.Join(dir, "scale.mid")
+	if err = scale.SaveMIDI(midiFile, 120, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// training every time the player opens does not add up
+	historyFile := filepath.Join(dir, "history.json")
+	for run := 0; run < 3; run++ {
+		p, err := NewWithDevice(240, 400, historyFile, false, piano.NewLoopback())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.MusicHistory.Len() != 0 {
+			t.Errorf("history has %d notes after training %d times", p.MusicHistory.Len(), run)
+		}
+		if err = p.LoadMIDI(midiFile); err != nil {
+			t.Fatal(err)
+		}
+		if learned := p.learningMusic().Len(); learned != 8 {
+			t.Errorf("AI learns from %d notes", learned)
+		}
+		if err = p.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the AI learns from the scale, and then from the history
+	p := &Player{TicksPerBeat: 100, MusicHistory: music.New(), training: scale}
+	p.MusicHistory.AddNote(music.Note{On: true, Pitch: 72, Velocity: 80, Beat: 0})
+	learned := p.learningMusic().GetAll()
+	if len(learned) != 9 || learned[8].Pitch != 72 || learned[8].Beat != 490 {
+		t.Errorf("AI learns from %+v", learned)
+	}
+}
+
+func TestPlayerImprovises(t *testing.T) {
+	p, device, cleanup := newTestPlayer(t)
+	defer cleanup()
+
+	// the highest key asks for an improvisation
+	device.Play(piano.Event{Status: 0x90, Data1: 108, Data2: 100})
+	if !waitFor(func() bool { return len(device.Written()) > 0 }) {
+		t.Fatal("nothing was played by the AI")
+	}
+	for _, event := range device.Written() {
+		if event.Status&0xF0 != 0x90 && event.Status&0xF0 != 0x80 {
+			t.Errorf("unexpected event %+v", event)
+		}
+	}
+	if p.MusicHistory.Len() == 0 {
+		t.Error("history was not loaded")
+	}
+}
+
+func TestPlayerStates(t *testing.T) {
+	device := piano.NewLoopback()
+	p, cleanup := startTestPlayer(t, device, func(p *Player) {
+		// a fast clock, so the improvisation ends soon
+		p.Clock = NewInternalClock(4000)
+	})
+	defer cleanup()
+	if p.State() != Listening {
+		t.Fatalf("player is %s, expected listening", p.State())
+	}
+
+	device.Play(piano.Event{Status: 0x90, Data1: 108, Data2: 100})
+	if !waitFor(func() bool { return p.State() == Improvising }) {
+		t.Fatalf("player is %s, expected improvising", p.State())
+	}
+	// asking again while improvising does nothing
+	device.Play(piano.Event{Status: 0x90, Data1: 108, Data2: 100})
+	// the panic key stops the improvisation
+	device.Play(piano.Event{Status: 0x90, Data1: 23, Data2: 100})
+	if !waitFor(func() bool { return p.State() == Listening }) {
+		t.Fatalf("player is %s, expected listening", p.State())
+	}
+	if p.MusicFuture.Len() != 0 {
+		t.Error("improvisation was not dropped")
+	}
+
+	// the improvisation ends by itself
+	p.Improvisation()
+	if !waitFor(func() bool { return p.State() == Improvising }) {
+		t.Fatalf("player is %s, expected improvising", p.State())
+	}
+	last, _ := p.MusicFuture.Last()
+	if !waitFor(func() bool { return p.CurrentTick() > last && p.State() == Listening }) {
+		t.Errorf("player is %s at tick %d, expected listening after tick %d", p.State(), p.CurrentTick(), last)
+	}
+}
+
+func TestPlayerPerformer(t *testing.T) {
+	performance := music.New()
+	performance.BPM = 240
+	performance.TicksPerBeat = 100
+	for i, pitch := range []int{72, 74, 76, 77} {
+		performance.AddNote(music.Note{On: true, Pitch: pitch, Velocity: 90, Beat: i * 20})
+		performance.AddNote(music.Note{On: false, Pitch: pitch, Velocity: 0, Beat: i*20 + 15})
+	}
+	output := piano.NewLoopback()
+	performer := piano.NewPerformer(performance, output)
+	p, cleanup := startTestPlayer(t, performer, func(p *Player) {
+		p.ManualAI = false
+	})
+	defer cleanup()
+
+	<-performer.Finished()
+	// the pause after the performance makes the AI improvise
+	if !waitFor(func() bool { return len(output.Written()) > 0 }) {
+		t.Fatal("nothing was played by the AI")
+	}
+	played := 0
+	for _, note := range p.MusicHistory.GetAll() {
+		if note.Pitch == 77 && note.On {
+			played++
+		}
+	}
+	if played == 0 {
+		t.Error("performance was not recorded")
+	}
+}
+
+// unplugged is a keyboard that cannot be opened
+type unplugged struct {
+	*piano.Loopback
+}
+
+func (d unplugged) Open() error {
+	return errors.New("no keyboard")
+}
+
+func TestPlayerReconnects(t *testing.T) {
+	keyboards := make(chan *piano.Loopback, 2)
+	watcher := piano.NewWatcher(func() piano.Device {
+		select {
+		case keyboard := <-keyboards:
+			return keyboard
+		default:
+			return unplugged{piano.NewLoopback()}
+		}
+	})
+	watcher.Interval = 5 * time.Millisecond
+	p, cleanup := startTestPlayer(t, watcher, nil)
+	defer cleanup()
+
+	before := p.MusicHistory.Len()
+	for i := 0; i < 2; i++ {
+		keyboard := piano.NewLoopback()
+		keyboard.Name = fmt.Sprintf("keyboard %d", i)
+		keyboards <- keyboard
+		if !waitFor(watcher.Connected) {
+			t.Fatal("keyboard was not connected")
+		}
+		keyboard.Play(
+			piano.Event{Status: 0x90, Data1: 72, Data2: 100},
+			piano.Event{Status: 0x80, Data1: 72, Data2: 0},
+		)
+		if !waitFor(func() bool { return p.MusicHistory.Len() == before+2*(i+1) }) {
+			t.Fatalf("recorded %d notes after connecting %d times", p.MusicHistory.Len()-before, i+1)
+		}
+		p.MusicHistory.RLock()
+		device := p.MusicHistory.Device
+		p.MusicHistory.RUnlock()
+		if device != keyboard.Name {
+			t.Errorf("history is recorded on %q, expected %q", device, keyboard.Name)
+		}
+		// unplug it
+		keyboard.Close()
+		if !waitFor(func() bool { return !watcher.Connected() }) {
+			t.Fatal("keyboard was not disconnected")
+		}
+	}
+}
+
+func TestPlayerFollowsLastConnection(t *testing.T) {
+	watcher := piano.NewWatcher(func() piano.Device {
+		return unplugged{piano.NewLoopback()}
+	})
+	watcher.Interval = time.Hour
+	p, cleanup := startTestPlayer(t, watcher, nil)
+	defer cleanup()
+
+	// more changes than the player can keep up with, it
+	// ends up in the state of the last one
+	for _, last := range []bool{true, false, true} {
+		for i := 0; i < 100; i++ {
+			watcher.OnConnect(i%2 == 0)
+		}
+		watcher.OnConnect(last)
+		if !waitFor(func() bool { return (p.State() != Paused) == last }) {
+			t.Fatalf("player is %s after connecting: %v", p.State(), last)
+		}
+	}
+}
+
+func TestPlayerVoices(t *testing.T) {
+	device := piano.NewLoopback()
+	_, cleanup := startTestPlayer(t, device, func(p *Player) {
+		p.AIVoice = piano.Voice{Channel: 1, Program: 41}
+		p.Click = true
+	})
+	defer cleanup()
+
+	device.Play(piano.Event{Status: 0x90, Data1: 108, Data2: 100})
+	if !waitFor(func() bool {
+		for _, event := range device.Written() {
+			if event.Status == 0x91 {
+				return true
+			}
+		}
+		return false
+	}) {
+		t.Fatal("nothing was played by the AI")
+	}
+	written := device.Written()
+	if written[2] != (piano.Event{Status: 0xC1, Data1: 40, Timestamp: written[2].Timestamp}) {
+		t.Errorf("program was not changed first: %+v", written[:3])
+	}
+	clicks := 0
+	for _, event := range written[3:] {
+		switch event.Status {
+		case 0x91, 0x81:
+		case 0x99, 0x89:
+			clicks++
+		default:
+			t.Errorf("unexpected event %+v", event)
+		}
+	}
+	if clicks == 0 {
+		t.Error("no click was played")
+	}
+}
+
+func TestEmitReleasesNotesWhileHostPlays(t *testing.T) {
+	// the player is not started, so its ticks can be set
+	dir, err := ioutil.TempDir("", "player")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p, err := NewWithDevice(240, 400, filepath.Join(dir, "history.json"), false, piano.NewLoopback())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	p.MusicFuture.AddNote(music.Note{On: true, Pitch: 72, Velocity: 100, Beat: 1000})
+	p.MusicFuture.AddNote(music.Note{On: false, Pitch: 72, Velocity: 0, Beat: 1010})
+	p.MusicFuture.AddNote(music.Note{On: true, Pitch: 74, Velocity: 100, Beat: 1010})
+	p.Tick = 1000
+	p.Emit(1000, 1001)
+	if !waitFor(func() bool { return len(p.Piano.Sounding()) == 1 }) {
+		t.Fatal("note was not played")
+	}
+	// the host starts playing
+	p.Tick = 1010
+	p.LastHostPress = 1005
+	p.Emit(1010, 1011)
+	if !waitFor(func() bool { return len(p.Piano.Sounding()) == 0 }) {
+		t.Errorf("%+v are still sounding", p.Piano.Sounding())
+	}
+}
+
+func TestEmitLiftsPedalWhileHostPlays(t *testing.T) {
+	dir, err := ioutil.TempDir("", "player")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	device := piano.NewLoopback()
+	p, err := NewWithDevice(240, 400, filepath.Join(dir, "history.json"), false, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	p.MusicFuture.AddNote(music.Note{Kind: music.ControlEvent, Pitch: music.SustainPedal, Velocity: 127, Beat: 1000})
+	p.MusicFuture.AddNote(music.Note{Kind: music.ControlEvent, Pitch: music.SustainPedal, Velocity: 0, Beat: 1010})
+	p.MusicFuture.AddNote(music.Note{Kind: music.ControlEvent, Pitch: 1, Velocity: 90, Beat: 1010})
+	p.Tick = 1000
+	p.Emit(1000, 1001)
+	// the host starts playing, the AI lets go of the pedal
+	p.Tick = 1010
+	p.LastHostPress = 1005
+	p.Emit(1010, 1011)
+	var controls [][2]int
+	if !waitFor(func() bool {
+		controls = nil
+		for _, event := range device.Written() {
+			if event.Status == 0xB0 {
+				controls = append(controls, [2]int{event.Data1, event.Data2})
+			}
+		}
+		return len(controls) >= 2
+	}) {
+		t.Fatalf("sent %v", controls)
+	}
+	// but it does not move the other controls
+	if expected := [][2]int{{music.SustainPedal, 127}, {music.SustainPedal, 0}}; !reflect.DeepEqual(controls, expected) {
+		t.Errorf("sent %v, expected %v", controls, expected)
+	}
+}
+
+func TestPanicKey(t *testing.T) {
+	p, device, cleanup := newTestPlayer(t)
+	defer cleanup()
+	p.MusicFuture.AddNote(music.Note{On: true, Pitch: 72, Velocity: 100, Beat: 1000000})
+
+	device.Play(piano.Event{Status: 0x90, Data1: 23, Data2: 100})
+	if !waitFor(func() bool {
+		for _, event := range device.Written() {
+			if event.Status == 0xB0 && event.Data1 == 123 {
+				return true
+			}
+		}
+		return false
+	}) {
+		t.Fatal("all notes off was not sent")
+	}
+	if p.MusicFuture.Len() != 0 {
+		t.Error("notes to play were not dropped")
+	}
+}
+
+func TestEmitOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "player")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	device := piano.NewLoopback()
+	p, err := NewWithDevice(240, 400, filepath.Join(dir, "history.json"), false, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Click = true
+	p.LastHostPress = -1000
+	for tick := 70; tick < 130; tick += 10 {
+		p.MusicFuture.AddNote(music.Note{On: true, Pitch: tick - 40, Velocity: 100, Beat: tick})
+		p.MusicFuture.AddNote(music.Note{On: false, Pitch: tick - 40, Velocity: 0, Beat: tick + 5})
+	}
+	// a clock that moves many ticks at once
+	p.Tick = 130
+	p.Emit(71, 131)
+	p.Close()
+
+	var pitches []int
+	for _, event := range device.Written() {
+		if event.Status&0xF0 == 0x90 {
+			pitches = append(pitches, event.Data1)
+		}
+	}
+	// the click of the second beat is on tick 100, after the note
+	// of that tick, and the note of tick 70 was already played
+	expected := []int{40, 50, 60, 37, 70, 80}
+	if !reflect.DeepEqual(pitches, expected) {
+		t.Errorf("played %v, expected %v", pitches, expected)
+	}
+}
+
+func TestListenUsesTimestamps(t *testing.T) {
+	device := piano.NewLoopback()
+	p, cleanup := startTestPlayer(t, device, func(p *Player) {
+		p.Quantize = 0
+	})
+	defer cleanup()
+	// let the clock run for a while
+	time.Sleep(50 * time.Millisecond)
+
+	start := device.Now()
+	device.Play(piano.Event{Status: 0x90, Data1: 72, Data2: 100, Timestamp: start})
+	// the note off is read 80 ms after it was played
+	time.Sleep(100 * time.Millisecond)
+	device.Play(piano.Event{Status: 0x80, Data1: 72, Data2: 0, Timestamp: start + 20})
+
+	var on, off music.Note
+	if !waitFor(func() bool {
+		for _, note := range p.MusicHistory.GetAll() {
+			if note.Pitch == 72 && note.On {
+				on = note
+			} else if note.Pitch == 72 {
+				off = note
+			}
+		}
+		return on.On && off.Beat > 0
+	}) {
+		t.Fatal("note was not recorded")
+	}
+	// 20 ms at 400 ticks per second
+	if duration := off.Beat - on.Beat; duration < 6 || duration > 10 {
+		t.Errorf("note lasted %d ticks, expected 8", duration)
+	}
+}
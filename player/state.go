@@ -0,0 +1,105 @@
+package player
+
+import (
+	"time"
+
+	"github.com/schollz/pianoai/music"
+	log "github.com/sirupsen/logrus"
+)
+
+// State is what the player is doing. Only the thread of Start
+// changes it, see Player.transition.
+type State int
+
+const (
+	// Listening records the host, and waits for a pause to improvise
+	Listening State = iota
+	// Learning waits for the AI to learn from the history
+	Learning
+	// Improvising plays the improvisation of the AI
+	Improvising
+	// Playback plays back the history
+	Playback
+	// Paused waits for the keyboard to be plugged in
+	Paused
+)
+
+func (s State) String() string {
+	switch s {
+	case Listening:
+		return "listening"
+	case Learning:
+		return "learning"
+	case Improvising:
+		return "improvising"
+	case Playback:
+		return "playback"
+	case Paused:
+		return "paused"
+	}
+	return "unknown"
+}
+
+// learning is the result of the AI, sent back to Start
+type learning struct {
+	// id tells whether the result is still wanted
+	id   int
+	lick *music.Music
+	// took is how long the AI took
+	took time.Duration
+	// scale is how much the lick was stretched
+	scale float64
+	// answer is the length of the phrase that is answered
+	answer int
+	err    error
+}
+
+// transition changes the state of the player
+func (p *Player) transition(to State) {
+	if to == p.state {
+		return
+	}
+	log.WithFields(log.Fields{
+		"function": "Player.transition",
+	}).Debugf("%s -> %s", p.state, to)
+	from := p.state
+	p.state = to
+	p.status.Lock()
+	p.status.state = to
+	p.status.Unlock()
+	p.publish(Event{Kind: StateChange, Tick: p.Tick, State: to, Previous: from})
+}
+
+// settle goes to the state, or goes to it after the keyboard
+// is plugged in again when the player is paused
+func (p *Player) settle(to State) {
+	if p.state == Paused {
+		p.resume = to
+		return
+	}
+	p.transition(to)
+}
+
+// State returns what the player is doing, it is safe to call
+// from any thread
+func (p *Player) State() State {
+	p.status.Lock()
+	defer p.status.Unlock()
+	return p.status.state
+}
+
+// CurrentTick returns the tick of the player, it is safe to
+// call from any thread
+func (p *Player) CurrentTick() int {
+	p.status.Lock()
+	defer p.status.Unlock()
+	return p.status.tick
+}
+
+// request runs the function on the thread of Start
+func (p *Player) request(f func()) {
+	select {
+	case p.commands <- f:
+	case <-p.closing:
+	}
+}
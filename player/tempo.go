@@ -0,0 +1,155 @@
+package player
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/schollz/pianoai/music"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxOnsets is how many of the last onsets of the host are
+	// used to estimate the tempo
+	maxOnsets = 48
+	// minOnsets is how many onsets are needed to estimate the tempo
+	minOnsets = 8
+	// tempoConfidence is how well the onsets must fit the beat
+	// of an estimated tempo for it to be used, from 0 to 1
+	tempoConfidence = 0.6
+	// maxTaps is how many of the last taps set the tempo
+	maxTaps = 5
+	// minTapBPM and maxTapBPM are the slowest and the fastest tempos
+	// that can be tapped
+	minTapBPM = 30
+	maxTapBPM = 300
+)
+
+// beatPeriod finds the period, in ticks, of the beat that the onsets
+// fit best, within a fifth of the expected period. The confidence
+// tells how well they fit, from 0 for onsets all over the place to 1
+// for onsets that are exactly on the beat.
+func beatPeriod(onsets []int, expected float64) (period, confidence float64) {
+	onsets = mergeChords(onsets, expected/16)
+	if len(onsets) < 2 || expected <= 0 {
+		return expected, 0
+	}
+	for candidate := expected / 1.25; candidate <= expected*1.25; candidate += expected / 400 {
+		// onsets on half beats cancel out on the beat, but they fit the
+		// grid of half beats. That grid counts a little less, as beats
+		// also fit the half beats of two thirds of a beat.
+		fit := math.Max(gridFit(onsets, candidate), 0.9*gridFit(onsets, candidate/2))
+		if fit > confidence {
+			period, confidence = candidate, fit
+		}
+	}
+	return
+}
+
+// gridFit returns how well the onsets fall on a grid of the period,
+// whatever its phase, as the length of the mean of the onsets
+// wrapped around a circle of the period
+func gridFit(onsets []int, period float64) float64 {
+	var x, y float64
+	for _, onset := range onsets {
+		angle := 2 * math.Pi * float64(onset) / period
+		x += math.Cos(angle)
+		y += math.Sin(angle)
+	}
+	return math.Hypot(x, y) / float64(len(onsets))
+}
+
+// mergeChords keeps the first onset of the onsets that are closer
+// than the gap, so the notes of a chord count once
+func mergeChords(onsets []int, gap float64) (merged []int) {
+	sorted := append([]int(nil), onsets...)
+	sort.Ints(sorted)
+	for _, onset := range sorted {
+		if len(merged) > 0 && float64(onset-merged[len(merged)-1]) < gap {
+			continue
+		}
+		merged = append(merged, onset)
+	}
+	return
+}
+
+// scaleLick stretches the lick so its beats, which are the beats
+// of the host it was learned from, last as long as the beats of the
+// player. The beat of the host is found from the onsets of the host
+// at the tempo of the player. It returns the lick and how much it
+// was stretched.
+func scaleLick(lick *music.Music, onsets []int, ticksPerBeat int) (scaled *music.Music, factor float64) {
+	period, confidence := beatPeriod(onsets, float64(ticksPerBeat))
+	factor = float64(ticksPerBeat) / period
+	if confidence < tempoConfidence || math.Abs(factor-1) < 0.02 {
+		return lick, 1
+	}
+	return lick.Stretch(factor), factor
+}
+
+// onset adds a key pressed by the host to the onsets, and estimates
+// the tempo once every beat. The tempo is changed when the player
+// follows the host, otherwise it is only proposed.
+func (p *Player) onset(tick int) {
+	logger := log.WithFields(log.Fields{
+		"function": "Player.onset",
+	})
+	if !p.EstimateTempo && !p.FollowTempo {
+		return
+	}
+	p.onsets = append(p.onsets, tick)
+	if len(p.onsets) > maxOnsets {
+		p.onsets = p.onsets[len(p.onsets)-maxOnsets:]
+	}
+	if len(p.onsets) < minOnsets || tick-p.lastEstimate < p.TicksPerBeat {
+		return
+	}
+	p.lastEstimate = tick
+	period, confidence := beatPeriod(p.onsets, float64(p.TicksPerBeat))
+	bpm := int(math.Floor(float64(p.BPM*p.TicksPerBeat)/period + 0.5))
+	if confidence < tempoConfidence || bpm == p.BPM || bpm == p.proposedBPM {
+		return
+	}
+	p.proposedBPM = bpm
+	logger.Infof("Host is playing at %d bpm (%.0f%% sure)", bpm, 100*confidence)
+	p.publish(Event{Kind: TempoEstimated, Tick: p.Tick, BPM: bpm, Confidence: confidence})
+	if p.FollowTempo {
+		p.setTempo(bpm)
+	}
+}
+
+// tempoOnsets returns a copy of the onsets for stretching the licks
+// to the beat of the player, or nil when the tempo of the host is
+// not estimated
+func (p *Player) tempoOnsets() []int {
+	if !p.EstimateTempo && !p.FollowTempo {
+		return nil
+	}
+	return append([]int{}, p.onsets...)
+}
+
+// tap sets the tempo to the time between the last taps
+func (p *Player) tap() {
+	now := time.Now()
+	if len(p.taps) > 0 {
+		interval := now.Sub(p.taps[len(p.taps)-1])
+		// a tap right after another is a bounce of the key or the
+		// pedal, and a tap after a long pause starts over
+		if interval < time.Minute/maxTapBPM {
+			return
+		}
+		if interval > time.Minute/minTapBPM {
+			p.taps = nil
+		}
+	}
+	p.taps = append(p.taps, now)
+	if len(p.taps) > maxTaps {
+		p.taps = p.taps[len(p.taps)-maxTaps:]
+	}
+	if len(p.taps) < 3 {
+		return
+	}
+	beat := p.taps[len(p.taps)-1].Sub(p.taps[0]) / time.Duration(len(p.taps)-1)
+	p.setTempo(int(math.Floor(float64(time.Minute)/float64(beat) + 0.5)))
+}
@@ -0,0 +1,147 @@
+package player
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/schollz/pianoai/music"
+	"github.com/schollz/pianoai/piano"
+)
+
+func TestBeatPeriod(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var beats, eighths, chords, random []int
+	for i := 0; i < 24; i++ {
+		// slower than expected, a little out of time
+		beats = append(beats, i*110+r.Intn(5)-2)
+		eighths = append(eighths, i*55)
+		chords = append(chords, i*90, i*90+2, i*90+3)
+		random = append(random, r.Intn(2000))
+	}
+	for _, test := range []struct {
+		name   string
+		onsets []int
+		period float64
+	}{
+		{"beats", beats, 110},
+		{"eighths", eighths, 110},
+		{"chords", chords, 90},
+	} {
+		period, confidence := beatPeriod(test.onsets, 100)
+		if math.Abs(period-test.period) > 1 || confidence < tempoConfidence {
+			t.Errorf("%s have a period of %.1f (%.2f sure), expected %.0f", test.name, period, confidence, test.period)
+		}
+	}
+	if _, confidence := beatPeriod(random, 100); confidence >= tempoConfidence {
+		t.Errorf("random onsets have a beat (%.2f sure)", confidence)
+	}
+}
+
+func TestScaleLick(t *testing.T) {
+	var onsets []int
+	for i := 0; i < 16; i++ {
+		onsets = append(onsets, i*120)
+	}
+	lick := music.New()
+	lick.AddNote(music.Note{On: true, Pitch: 62, Velocity: 80, Beat: 240})
+	scaled, factor := scaleLick(lick, onsets, 100)
+	if math.Abs(factor-100.0/120) > 0.01 {
+		t.Errorf("lick was stretched by %.2f", factor)
+	}
+	if first, _ := scaled.First(); first < 198 || first > 202 {
+		t.Errorf("lick starts at %d, expected 200", first)
+	}
+	// a history in time with the player is left alone
+	if _, factor = scaleLick(lick, onsets, 120); factor != 1 {
+		t.Errorf("lick was stretched by %.2f", factor)
+	}
+}
+
+func TestPlayerTempo(t *testing.T) {
+	device := piano.NewLoopback()
+	p, cleanup := startTestPlayer(t, device, func(p *Player) {
+		p.Controls.Set("tap=cc20")
+		p.FollowTempo = true
+	})
+	defer cleanup()
+	events, cancel := p.Subscribe()
+	defer cancel()
+	tempo := func() (bpm int) {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case event := <-events:
+				if event.Kind == TempoChanged {
+					return event.BPM
+				}
+			case <-timeout:
+				t.Fatal("tempo did not change")
+			}
+		}
+	}
+
+	// three taps at 200 bpm, and a bounce of the pedal that is ignored
+	for i := 0; i < 3; i++ {
+		device.Play(
+			piano.Event{Status: 0xB0, Data1: 20, Data2: 127},
+			piano.Event{Status: 0xB0, Data1: 20, Data2: 0},
+		)
+		if i == 1 {
+			time.Sleep(20 * time.Millisecond)
+			device.Play(
+				piano.Event{Status: 0xB0, Data1: 20, Data2: 127},
+				piano.Event{Status: 0xB0, Data1: 20, Data2: 0},
+			)
+			time.Sleep(280 * time.Millisecond)
+		} else {
+			time.Sleep(300 * time.Millisecond)
+		}
+	}
+	if bpm := tempo(); bpm < 180 || bpm > 220 {
+		t.Errorf("tapped %d bpm, expected 200", bpm)
+	}
+
+	// the host plays a little faster than that, a note
+	// every 90 ticks, which the player follows
+	for i := 0; i < minOnsets+2; i++ {
+		device.Play(piano.Event{Status: 0x90, Data1: 72, Data2: 100})
+		time.Sleep(270 * time.Millisecond)
+	}
+	if bpm := tempo(); bpm <= 200 {
+		t.Errorf("followed the host to %d bpm, expected more than 200", bpm)
+	}
+}
+
+func TestPlayerKeepsLicksAtFixedTempo(t *testing.T) {
+	device := piano.NewLoopback()
+	p, cleanup := startTestPlayer(t, device, func(p *Player) {
+		// the history was played a lot slower than the player
+		last, _ := p.MusicHistory.Last()
+		for i := 1; i <= maxOnsets; i++ {
+			p.MusicHistory.AddNote(music.Note{On: true, Pitch: 72, Velocity: 80, Beat: last + i*120})
+			p.MusicHistory.AddNote(music.Note{On: false, Pitch: 72, Velocity: 0, Beat: last + i*120 + 60})
+		}
+	})
+	defer cleanup()
+	events, cancel := p.Subscribe()
+	defer cancel()
+
+	p.Improvisation()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.Kind != LickGenerated {
+				continue
+			}
+			if event.Lick.Scale != 1 {
+				t.Errorf("lick was stretched by %.2f with a fixed tempo", event.Lick.Scale)
+			}
+			return
+		case <-timeout:
+			t.Fatal("no lick was generated")
+		}
+	}
+}
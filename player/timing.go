@@ -0,0 +1,95 @@
+package player
+
+import (
+	"sync"
+	"time"
+)
+
+// timeline converts the timestamps of the events of the device to ticks
+// of the player. The clock of the player marks when it reaches each
+// tick, and the timestamps are matched against those marks, so that
+// the tick of an event does not depend on when it is read.
+type timeline struct {
+	// tick is the last tick that was reached, at the time at
+	tick int
+	at   time.Time
+	// period is the average time between ticks
+	period time.Duration
+	// zero is the time of the player at the zero timestamp of the
+	// device, taken from the event that was read the fastest
+	zero time.Time
+	sync.Mutex
+}
+
+// reset starts the timeline again at the tick, keeping the tick period
+// unless a new one is given
+func (l *timeline) reset(tick int, now time.Time, period time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	l.tick = tick
+	l.at = now
+	if period > 0 {
+		l.period = period
+	}
+}
+
+// advance marks that the clock reached the tick
+func (l *timeline) advance(tick int, now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	if !l.at.IsZero() && tick > l.tick {
+		period := now.Sub(l.at) / time.Duration(tick-l.tick)
+		if l.period == 0 {
+			l.period = period
+		} else {
+			l.period = (7*l.period + period) / 8
+		}
+	}
+	l.tick = tick
+	l.at = now
+}
+
+// tickOf returns the tick of an event with the timestamp of the
+// device in milliseconds, which was read at the time now
+func (l *timeline) tickOf(timestamp int64, now time.Time) (tick int) {
+	l.Lock()
+	defer l.Unlock()
+	if l.at.IsZero() || l.period <= 0 {
+		return l.tick
+	}
+	deviceTime := time.Duration(timestamp) * time.Millisecond
+	// the zero is taken again when the device clock is
+	// reset, for example after reconnecting the device
+	zero := now.Add(-deviceTime)
+	if l.zero.IsZero() || zero.Before(l.zero) || zero.Sub(l.zero) > time.Second {
+		l.zero = zero
+	}
+	since := l.zero.Add(deviceTime).Sub(l.at)
+	if since < 0 {
+		since -= l.period / 2
+	} else {
+		since += l.period / 2
+	}
+	tick = l.tick + int(since/l.period)
+	// the events cannot be later than the clock, which
+	// also keeps them in place while the clock is stopped
+	if tick > l.tick {
+		tick = l.tick
+	}
+	if tick < 0 {
+		tick = 0
+	}
+	return
+}
+
+// timeOf returns when the clock reaches the tick, from the last tick
+// that was reached and the tick period, or the zero time when the
+// clock did not start yet
+func (l *timeline) timeOf(tick int) time.Time {
+	l.Lock()
+	defer l.Unlock()
+	if l.at.IsZero() {
+		return time.Time{}
+	}
+	return l.at.Add(time.Duration(tick-l.tick) * l.period)
+}
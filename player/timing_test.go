@@ -0,0 +1,47 @@
+package player
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeline(t *testing.T) {
+	var l timeline
+	start := time.Now()
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+	// without ticks every event is at the first tick
+	if tick := l.tickOf(0, at(0)); tick != 0 {
+		t.Errorf("event before the clock is at %d", tick)
+	}
+
+	// a tick every 2 ms, and the device clock starts 1000 ms earlier
+	for tick := 0; tick <= 100; tick++ {
+		l.advance(tick, at(2*tick))
+	}
+	// read right away, which sets the zero of the device
+	if tick := l.tickOf(1200, at(200)); tick != 100 {
+		t.Errorf("event read right away is at %d, expected 100", tick)
+	}
+	// read 30 ms late
+	if tick := l.tickOf(1170, at(200)); tick != 85 {
+		t.Errorf("late event is at %d, expected 85", tick)
+	}
+	// an event read slowly does not move the zero
+	l.advance(101, at(202))
+	if tick := l.tickOf(1190, at(240)); tick != 95 {
+		t.Errorf("slow event is at %d, expected 95", tick)
+	}
+	// an event cannot be after the clock
+	if tick := l.tickOf(1300, at(202)); tick != 101 {
+		t.Errorf("future event is at %d, expected 101", tick)
+	}
+	// the device was reconnected, and its clock starts again
+	if tick := l.tickOf(5, at(202)); tick != 101 {
+		t.Errorf("event after reconnecting is at %d, expected 101", tick)
+	}
+	if tick := l.tickOf(3, at(202)); tick != 100 {
+		t.Errorf("event after reconnecting is at %d, expected 100", tick)
+	}
+}